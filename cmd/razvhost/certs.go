@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/server"
+)
+
+const certsUsage = "Usage: razvhost [-admin <addr>] [-admin-token <token>] certs list|renew <name>|revoke <name>"
+
+// certs lists, renews or revokes certificates and returns the exit code.
+// Renewing and revoking is done by the running server through the admin interface given by -admin.
+// Listing without -admin reads the certificates from the -certs directory.
+func certs(args []string) int {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+	switch flag.Arg(0) {
+	case "list":
+		return listCerts()
+	case "renew", "revoke":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, certsUsage)
+			return 2
+		}
+		return adminCertAction(flag.Arg(0), flag.Arg(1))
+	default:
+		fmt.Fprintln(os.Stderr, certsUsage)
+		return 2
+	}
+}
+
+func listCerts() int {
+	var certs []server.CertificateInfo
+	if len(AdminAddr) > 0 {
+		resp, err := adminRequest(http.MethodGet, "/certs")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			fmt.Fprintln(os.Stderr, responseError(resp))
+			return 1
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		acme, err := server.NewACMEConfig(ACMEDirectory, ACMEEmail, ACMEEABKeyID, ACMEEABHMAC, ACMEKeyType, ACMECAFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if certs, err = server.ListCertificates(CertsDir, acme); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSOURCE\tSUBJECT\tDNS NAMES\tISSUER\tEXPIRES")
+	for _, cert := range certs {
+		expires := cert.NotAfter.Format("2006-01-02 15:04")
+		if left := time.Until(cert.NotAfter); left <= 0 {
+			expires += " (expired)"
+		} else {
+			expires += fmt.Sprintf(" (%d days)", int(left.Hours()/24))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", cert.Name, cert.Source, cert.Subject,
+			strings.Join(cert.DNSNames, ","), cert.Issuer, expires)
+	}
+	w.Flush()
+	return 0
+}
+
+func adminCertAction(action, name string) int {
+	if len(AdminAddr) == 0 {
+		fmt.Fprintf(os.Stderr, "certs %s requires the admin interface address of the running server (-admin)\n", action)
+		return 2
+	}
+	resp, err := adminRequest(http.MethodPost, "/certs/"+action+"?name="+url.QueryEscape(name))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Fprintln(os.Stderr, responseError(resp))
+		return 1
+	}
+	if action == "renew" {
+		var cert server.CertificateInfo
+		if err := json.NewDecoder(resp.Body).Decode(&cert); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%s renewed, expires %s\n", name, cert.NotAfter.Format("2006-01-02 15:04"))
+	} else {
+		fmt.Println(name, "revoked")
+	}
+	return 0
+}
+
+// adminRequest sends a request to the admin interface of the running server, with the admin token if set
+func adminRequest(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+AdminAddr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(AdminToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+AdminToken)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func responseError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if msg := strings.TrimSpace(string(body)); len(msg) > 0 {
+		return msg
+	}
+	return resp.Status
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/handler"
+)
+
+// check validates the config and returns the exit code
+func check(args []string) int {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+
+	var phpaddr *url.URL
+	if len(PHPAddr) > 0 {
+		var err error
+		if phpaddr, err = url.Parse(PHPAddr); err != nil {
+			fmt.Println("ERROR: php-addr:", err)
+			return 1
+		}
+	}
+
+	result := config.Validate(ConfigFile, handler.NewHandlerFactory(phpaddr, Upstream))
+	for _, err := range result.Errors {
+		fmt.Println("ERROR:", err)
+	}
+	for _, warn := range result.Warnings {
+		fmt.Println("WARNING:", warn)
+	}
+	fmt.Printf("%s: %d routes, %d errors, %d warnings\n",
+		ConfigFile, len(result.Entries), len(result.Errors), len(result.Warnings))
+
+	if len(result.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/razzie/razvhost/pkg/config"
+)
+
+// convert prints the config converted to the structured format and returns the exit code
+func convert(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	format := flags.String("format", "yaml", "Output format (yaml or json)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: razvhost convert [-format yaml|json] [config file]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	filename := ConfigFile
+	if flags.NArg() > 0 {
+		filename = flags.Arg(0)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	out, err := config.ConvertConfig(file, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
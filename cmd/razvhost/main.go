@@ -4,18 +4,35 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/dns01"
+	"github.com/razzie/razvhost/pkg/handler"
+	"github.com/razzie/razvhost/pkg/listener"
 	"github.com/razzie/razvhost/pkg/server"
 )
 
 // command line args
 var (
+	HTTPAddrs         string
+	HTTPSAddrs        string
 	ConfigFile        string
 	CertsDir          string
+	WildcardCertRate  int
+	ACMEDirectory     string
+	ACMEEmail         string
+	ACMEEABKeyID      string
+	ACMEEABHMAC       string
+	ACMEKeyType       string
+	ACMECAFile        string
+	DNSProvider       string
+	DNSDelay          time.Duration
 	NoCert            bool
 	NoServerHeader    bool
 	WatchDockerEvents bool
@@ -23,6 +40,16 @@ var (
 	DiscardHeaders    string
 	PHPAddr           string
 	DebugAddr         string
+	AdminAddr         string
+	AdminToken        string
+	DrainTimeout      time.Duration
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	Upstream          handler.UpstreamConfig
+	StickySecret      string
 )
 
 var version string
@@ -41,8 +68,19 @@ var defaultDiscardHeaders = []string{
 
 func init() {
 	showVersion := flag.Bool("version", false, "Show version")
-	flag.StringVar(&ConfigFile, "cfg", "config", "Config file")
+	flag.StringVar(&HTTPAddrs, "http", ":80", "Comma separated list of HTTP listen addresses")
+	flag.StringVar(&HTTPSAddrs, "https", ":443", "Comma separated list of HTTPS listen addresses")
+	flag.StringVar(&ConfigFile, "cfg", "config", "Config file or directory")
 	flag.StringVar(&CertsDir, "certs", "certs", "Directory to store certificates in")
+	flag.IntVar(&WildcardCertRate, "wildcard-cert-rate", 10, "Maximum number of hostnames per hour to request certificates for on wildcard routes without cert.allow")
+	flag.StringVar(&ACMEDirectory, "acme-directory", "letsencrypt", "ACME directory URL, or letsencrypt, letsencrypt-staging or zerossl")
+	flag.StringVar(&ACMEEmail, "acme-email", "", "Contact email address of the ACME account")
+	flag.StringVar(&ACMEEABKeyID, "acme-eab-kid", "", "External Account Binding key ID (required by some CAs like ZeroSSL)")
+	flag.StringVar(&ACMEEABHMAC, "acme-eab-hmac", "", "External Account Binding HMAC key (base64url encoded)")
+	flag.StringVar(&ACMEKeyType, "acme-key-type", "auto", "Certificate key type: auto (ECDSA, or RSA for clients without ECDSA support), ecdsa or rsa")
+	flag.StringVar(&ACMECAFile, "acme-ca", "", "PEM file of CA certificates to verify the ACME server with (e.g. a local test CA)")
+	flag.StringVar(&DNSProvider, "dns-provider", "", "DNS provider URL to request wildcard certificates with DNS-01 challenges (rfc2136://... or exec://...)")
+	flag.DurationVar(&DNSDelay, "dns-propagation-delay", 30*time.Second, "Time to wait for DNS-01 challenge records to propagate")
 	flag.BoolVar(&NoCert, "nocert", false, "Disable HTTPS and certificate handling")
 	flag.BoolVar(&NoServerHeader, "no-server-header", false, "Disable 'Server: razvhost/<version>' header in responses")
 	flag.BoolVar(&WatchDockerEvents, "docker", false, "Watch Docker events to find containers with VIRTUAL_HOST")
@@ -50,6 +88,18 @@ func init() {
 	flag.StringVar(&DiscardHeaders, "discard-headers", "", "Comma separated list of http headers to discard")
 	flag.StringVar(&PHPAddr, "php-addr", "unix:///var/run/php/php-fpm.sock", "PHP CGI address")
 	flag.StringVar(&DebugAddr, "debug", "", "Debug listener address, where hostname is the first part of the URL")
+	flag.StringVar(&AdminAddr, "admin", "", "Admin interface address (serves /status, /stats, /certs and /metrics)")
+	flag.StringVar(&AdminToken, "admin-token", "", "Bearer token required by the admin interface (without it, certificates can only be renewed or revoked from localhost)")
+	flag.DurationVar(&DrainTimeout, "drain-timeout", 30*time.Second, "Time to wait for in-flight requests on shutdown")
+	flag.DurationVar(&ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Time allowed for clients to send request headers")
+	flag.DurationVar(&ReadTimeout, "read-timeout", 0, "Time allowed for clients to send the whole request (0 = no limit)")
+	flag.DurationVar(&WriteTimeout, "write-timeout", 0, "Time allowed for writing the response (0 = no limit)")
+	flag.DurationVar(&IdleTimeout, "idle-timeout", 2*time.Minute, "Time to keep idle keep-alive connections open")
+	flag.IntVar(&MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers")
+	flag.DurationVar(&Upstream.DialTimeout, "dial-timeout", 10*time.Second, "Timeout of connecting to upstream servers")
+	flag.DurationVar(&Upstream.TLSHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "Timeout of TLS handshakes with upstream servers")
+	flag.DurationVar(&Upstream.ResponseHeaderTimeout, "response-header-timeout", time.Minute, "Time to wait for upstream response headers (0 = no limit)")
+	flag.StringVar(&StickySecret, "sticky-secret", "", "Key to sign sticky session cookies with (random by default, so cookies don't survive restarts)")
 	flag.Parse()
 
 	if *showVersion {
@@ -64,13 +114,86 @@ func init() {
 	log.SetOutput(os.Stdout)
 }
 
-func waitForSignal() {
+// getListeners returns the listeners given by -http and -https.
+// The first listener of each protocol is named after the protocol, the others are named protocol-addr.
+func getListeners() ([]config.ListenerConfig, error) {
+	var listeners []config.ListenerConfig
+	for _, protocol := range []string{"http", "https"} {
+		addrs := HTTPAddrs
+		if protocol == "https" {
+			if NoCert {
+				break
+			}
+			addrs = HTTPSAddrs
+		}
+		opts := config.Options{"name": protocol}
+		if protocol == "http" && !NoCert {
+			opts["redirect"] = "true"
+		}
+		for _, addr := range strings.Split(addrs, ",") {
+			if addr = strings.TrimSpace(addr); len(addr) == 0 {
+				continue
+			}
+			l, err := config.NewListenerConfig(protocol, addr, opts)
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, l)
+			delete(opts, "name")
+		}
+	}
+	return listeners, nil
+}
+
+func waitForSignal(srv *server.Server) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-	<-sigChan
+	if len(upgradeSignals) > 0 {
+		signal.Notify(sigChan, upgradeSignals...)
+	}
+	for sig := range sigChan {
+		switch {
+		case sig == syscall.SIGHUP:
+			srv.Reload()
+		case len(upgradeSignals) > 0 && sig == upgradeSignals[0]:
+			upgrade()
+		default:
+			return
+		}
+	}
+}
+
+func upgrade() {
+	proc, err := listener.Upgrade()
+	if err != nil {
+		log.Println("Upgrade failed:", err)
+		return
+	}
+	log.Println("Upgrade: started new process", proc.Pid)
+	go func() {
+		state, err := proc.Wait()
+		if err != nil {
+			log.Println("Upgrade:", err)
+			return
+		}
+		log.Println("Upgrade: new process exited:", state)
+	}()
 }
 
 func main() {
+	switch flag.Arg(0) {
+	case "":
+	case "check":
+		os.Exit(check(flag.Args()[1:]))
+	case "convert":
+		os.Exit(convert(flag.Args()[1:]))
+	case "certs":
+		os.Exit(certs(flag.Args()[1:]))
+	default:
+		fmt.Println("Unknown command:", flag.Arg(0))
+		os.Exit(2)
+	}
+
 	var serverHeader map[string]string
 	if !NoServerHeader {
 		if len(version) > 0 {
@@ -80,8 +203,25 @@ func main() {
 		}
 	}
 
+	listeners, err := getListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	acme, err := server.NewACMEConfig(ACMEDirectory, ACMEEmail, ACMEEABKeyID, ACMEEABHMAC, ACMEKeyType, ACMECAFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(DNSProvider) > 0 {
+		if acme.DNSProvider, err = dns01.NewProvider(DNSProvider); err != nil {
+			log.Fatal(err)
+		}
+		acme.DNSDelay = DNSDelay
+	}
+
 	log.Println("Starting razvhost", version)
 	cfg := server.ServerConfig{
+		Listeners:         listeners,
 		ConfigFile:        ConfigFile,
 		CertsDir:          CertsDir,
 		NoCert:            NoCert,
@@ -90,22 +230,40 @@ func main() {
 		DiscardHeaders:    append(strings.Split(DiscardHeaders, ","), defaultDiscardHeaders...),
 		ExtraHeaders:      serverHeader,
 		PHPAddr:           PHPAddr,
+		DrainTimeout:      DrainTimeout,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+		MaxHeaderBytes:    MaxHeaderBytes,
+		Upstream:          Upstream,
+		StickySecret:      StickySecret,
+		WildcardCertRate:  WildcardCertRate,
+		AdminToken:        AdminToken,
+		ACME:              acme,
 	}
 	srv := server.NewServer(cfg)
 	if len(DebugAddr) > 0 {
 		go func() {
-			if err := srv.Debug(DebugAddr); err != nil {
+			if err := srv.Debug(DebugAddr); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if len(AdminAddr) > 0 {
+		go func() {
+			if err := srv.Admin(AdminAddr); err != nil && err != http.ErrServerClosed {
 				log.Fatal(err)
 			}
 		}()
 	}
 	go func() {
-		if err := srv.Serve(); err != nil {
+		if err := srv.Serve(); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 
-	waitForSignal()
+	waitForSignal(srv)
 
 	log.Println("Shutdown")
 	if err := srv.Shutdown(); err != nil {
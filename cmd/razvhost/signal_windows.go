@@ -0,0 +1,7 @@
+package main
+
+import (
+	"os"
+)
+
+var upgradeSignals []os.Signal
@@ -1,6 +1,6 @@
 module github.com/razzie/razvhost
 
-go 1.18
+go 1.21
 
 require (
 	github.com/Masterminds/sprig/v3 v3.2.3
@@ -14,6 +14,7 @@ require (
 	github.com/yookoala/gofast v0.7.0
 	golang.org/x/crypto v0.31.0
 	golang.org/x/net v0.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
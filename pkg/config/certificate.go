@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// CertificateConfig is a certificate loaded from PEM files, served for the given hostnames instead of ACME certificates
+type CertificateConfig struct {
+	CertFile    string
+	KeyFile     string
+	ChainFile   string   // optional CA bundle appended to the certificate chain
+	Hostnames   []string // exact names or *.domain wildcards, defaults to the DNS names of the certificate
+	Certificate *tls.Certificate
+}
+
+// Equal returns whether the certificates have the same files, hostnames and content
+func (c CertificateConfig) Equal(other CertificateConfig) bool {
+	if c.CertFile != other.CertFile || c.KeyFile != other.KeyFile || c.ChainFile != other.ChainFile ||
+		!slices.Equal(c.Hostnames, other.Hostnames) || (c.Certificate == nil) != (other.Certificate == nil) {
+		return false
+	}
+	return c.Certificate == nil || slices.EqualFunc(c.Certificate.Certificate, other.Certificate.Certificate, bytes.Equal)
+}
+
+// Load reads the certificate and key files, and sets the hostnames from the certificate if they are empty
+func (c *CertificateConfig) Load() error {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	if len(c.ChainFile) > 0 {
+		chain, err := os.ReadFile(c.ChainFile)
+		if err != nil {
+			return err
+		}
+		for block, rest := pem.Decode(chain); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" {
+				cert.Certificate = append(cert.Certificate, block.Bytes)
+			}
+		}
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if len(c.Hostnames) == 0 {
+		c.Hostnames = slices.Clone(cert.Leaf.DNSNames)
+	}
+	if len(c.Hostnames) == 0 {
+		return fmt.Errorf("%s: certificate has no DNS names, hostnames have to be given", c.CertFile)
+	}
+	for i, hostname := range c.Hostnames {
+		c.Hostnames[i] = strings.ToLower(hostname)
+	}
+	c.Certificate = &cert
+	return nil
+}
+
+// readCertificateDirective parses the arguments of a certificate directive:
+// <cert file> <key file> [hostname ...] [chain=<file>]
+// Relative paths are resolved from dir.
+func readCertificateDirective(dir, text string) (CertificateConfig, error) {
+	args, options, hasOptions := splitOptions(text)
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return CertificateConfig{}, fmt.Errorf("bad certificate directive, expected: certificate <cert file> <key file> [hostname ...] [chain=<file>]")
+	}
+	var opts Options
+	if hasOptions {
+		var err error
+		if opts, err = parseOptions(options); err != nil {
+			return CertificateConfig{}, err
+		}
+	}
+	for key := range opts {
+		if key != "chain" {
+			return CertificateConfig{}, fmt.Errorf("unknown certificate option: %s", key)
+		}
+	}
+	return newCertificateConfig(dir, fields[0], fields[1], opts.Get("chain", ""), fields[2:]), nil
+}
+
+// newCertificateConfig returns a certificate config with paths resolved from dir. The files are not loaded yet.
+func newCertificateConfig(dir, certFile, keyFile, chainFile string, hostnames []string) CertificateConfig {
+	resolve := func(path string) string {
+		if len(path) > 0 && !filepath.IsAbs(path) {
+			return filepath.Join(dir, path)
+		}
+		return path
+	}
+	return CertificateConfig{
+		CertFile:  resolve(certFile),
+		KeyFile:   resolve(keyFile),
+		ChainFile: resolve(chainFile),
+		Hostnames: hostnames,
+	}
+}
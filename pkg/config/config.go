@@ -1,12 +1,15 @@
 package config
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"net/http"
+	"net/netip"
 	"net/url"
-	"os"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,11 +18,15 @@ import (
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/fsnotify/fsnotify"
+	"github.com/razzie/razvhost/pkg/mux"
 )
 
 type ConfigEntry struct {
 	Hostname string
 	Target   url.URL
+	Options  Options
+	file     string
+	line     int
 }
 
 type ConfigEvent struct {
@@ -27,8 +34,137 @@ type ConfigEvent struct {
 	Up bool
 }
 
-func (e ConfigEvent) String() string {
+// ID uniquely identifies the entry including its target and options
+func (e ConfigEntry) ID() string {
+	return e.Hostname + " -> " + e.Target.String() + " " + e.Options.String()
+}
+
+// TargetOptions returns the options in the fragment of the target URL, like weight in http://a#weight=3&backup
+func (e ConfigEntry) TargetOptions() (Options, error) {
+	values, err := url.ParseQuery(e.Target.Fragment)
+	if err != nil {
+		return nil, fmt.Errorf("bad target options: %v", err)
+	}
+	opts := make(Options, len(values))
+	for key, value := range values {
+		switch key {
+		case "weight", "backup":
+		default:
+			return nil, fmt.Errorf("unknown target option: %s", key)
+		}
+		opts[key] = value[len(value)-1]
+	}
+	return opts, nil
+}
+
+// Backend returns the load balancing settings of the entry from its lb options and target options
+func (e ConfigEntry) Backend() (b mux.Backend, err error) {
+	targetOpts, err := e.TargetOptions()
+	if err != nil {
+		return
+	}
+	if b.Weight, err = targetOpts.Int("weight", 1); err != nil {
+		return
+	}
+	if b.Weight < 1 {
+		err = fmt.Errorf("weight has to be at least 1")
+		return
+	}
+	if b.Backup, err = targetOpts.Bool("backup", false); err != nil {
+		return
+	}
+	b.ID = e.ID()
+	b.Strategy = e.Options.Get("lb", "")
+	b.HashKey = e.Options.Get("lb.key", "")
+	switch sticky := e.Options.Get("lb.sticky", "false"); sticky {
+	case "false":
+	case "", "true":
+		b.Sticky = mux.DefaultStickyCookie
+	default:
+		if strings.ContainsAny(sticky, " \t;,=\"") {
+			err = fmt.Errorf("bad lb.sticky cookie name: %s", sticky)
+			return
+		}
+		b.Sticky = sticky
+	}
+	if len(b.Strategy) > 0 || len(b.HashKey) > 0 {
+		if _, err = mux.NewStrategy(b.Strategy, b.HashKey); err != nil {
+			return
+		}
+	}
+	b.Match, err = e.Matcher()
+	return
+}
+
+// Matcher returns the match conditions of the entry from its match.* options, or nil if it has none
+func (e ConfigEntry) Matcher() (*mux.Matcher, error) {
+	match := e.Options.Prefixed("match.")
+	if len(match) == 0 {
+		return nil, nil
+	}
+	m := &mux.Matcher{
+		Headers: make(map[string][]string),
+		Query:   make(map[string][]string),
+	}
+	for key := range match {
+		values := e.Options.List("match." + key)
+		switch {
+		case key == "method":
+			m.Methods = values
+		case key == "ip":
+			for _, value := range values {
+				prefix, err := parsePrefix(value)
+				if err != nil {
+					return nil, fmt.Errorf("bad match.ip: %s", value)
+				}
+				m.Nets = append(m.Nets, prefix)
+			}
+		case strings.HasPrefix(key, "header.") && len(key) > len("header."):
+			m.Headers[http.CanonicalHeaderKey(key[len("header."):])] = values
+		case strings.HasPrefix(key, "query.") && len(key) > len("query."):
+			m.Query[key[len("query."):]] = values
+		default:
+			return nil, fmt.Errorf("unknown match option: match.%s", key)
+		}
+	}
+	return m, nil
+}
+
+// parsePrefix parses a CIDR or a single IP address
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// CertAllow returns the cert.allow option, the hostname patterns a wildcard route can request certificates for
+func (e ConfigEntry) CertAllow() ([]string, error) {
+	patterns := e.Options.List("cert.allow")
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad cert.allow pattern: %s", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+func (e ConfigEntry) String() string {
 	str := e.Hostname + " -> " + e.Target.Redacted()
+	if len(e.Options) > 0 {
+		str += " " + e.Options.Redacted()
+	}
+	return str
+}
+
+func (e ConfigEvent) String() string {
+	str := e.ConfigEntry.String()
 	if e.Up {
 		str += " [UP]"
 	} else {
@@ -38,40 +174,58 @@ func (e ConfigEvent) String() string {
 }
 
 type Config struct {
-	C           <-chan []ConfigEvent
-	events      chan []ConfigEvent
-	filename    string
-	watcher     *fsnotify.Watcher
-	prevEntries []ConfigEntry
-	modCounter  uint32
-	mtx         sync.Mutex
+	C            <-chan []ConfigEvent
+	S            <-chan *Settings
+	events       chan []ConfigEvent
+	settings     chan *Settings
+	path         string
+	watcher      *fsnotify.Watcher
+	watches      map[string]bool
+	files        map[string]*configFile
+	prevEntries  []ConfigEntry
+	prevSettings *Settings
+	modCounter   uint32
+	mtx          sync.Mutex
 }
 
-func NewConfig(filename string) (*Config, error) {
-	entries, err := ReadConfigFile(filename)
-	if err != nil {
+// NewConfig reads and watches the config at path, which can be a file or a directory.
+// Files referenced by include directives are watched too.
+func NewConfig(path string) (*Config, error) {
+	loader := newConfigLoader(nil)
+	if err := loader.loadPath(path, nil); err != nil {
 		return nil, err
 	}
+	settings := loader.settings()
+	loader.logErrors()
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
-	if err := watcher.Add(filename); err != nil {
+	if err := watcher.Add(path); err != nil {
 		watcher.Close()
 		return nil, err
 	}
 
+	entries := loader.entries()
 	events := make(chan []ConfigEvent, 1)
 	events <- configEntries(entries).toEvents(true)
+	settingsCh := make(chan *Settings, 1)
+	settingsCh <- settings
 
 	cfg := &Config{
-		C:           events,
-		events:      events,
-		filename:    filename,
-		watcher:     watcher,
-		prevEntries: entries,
+		C:            events,
+		S:            settingsCh,
+		events:       events,
+		settings:     settingsCh,
+		path:         path,
+		watcher:      watcher,
+		watches:      map[string]bool{path: true},
+		files:        loader.files,
+		prevEntries:  entries,
+		prevSettings: settings,
 	}
+	cfg.updateWatches(loader.watches)
 	go func() {
 		for {
 			select {
@@ -80,7 +234,6 @@ func NewConfig(filename string) (*Config, error) {
 					return
 				}
 				go cfg.handleUpdate()
-				watcher.Add(filename)
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
@@ -94,6 +247,7 @@ func NewConfig(filename string) (*Config, error) {
 
 func (cfg *Config) Close() error {
 	close(cfg.events)
+	close(cfg.settings)
 	return cfg.watcher.Close()
 }
 
@@ -104,27 +258,71 @@ func (cfg *Config) handleUpdate() {
 	if atomic.LoadUint32(&cfg.modCounter) != modCount {
 		return
 	}
+	cfg.reload()
+}
 
-	newEntries, err := ReadConfigFile(cfg.filename)
-	if err != nil {
-		log.Println("Failed to read config file:", err)
-		return
-	}
+// Reload reads the config again immediately, without waiting for file changes to settle
+func (cfg *Config) Reload() {
+	// cancel pending updates
+	atomic.AddUint32(&cfg.modCounter, 1)
+	cfg.reload()
+}
 
+func (cfg *Config) reload() {
 	cfg.mtx.Lock()
 	defer cfg.mtx.Unlock()
 
+	loader := newConfigLoader(cfg.files)
+	if err := loader.loadPath(cfg.path, nil); err != nil {
+		log.Println("Failed to read config file:", err)
+		cfg.updateWatches(map[string]bool{cfg.path: true})
+		return
+	}
+	settings := loader.settings()
+	loader.logErrors()
+	cfg.updateWatches(loader.watches)
+
+	if !settings.Equal(cfg.prevSettings) {
+		log.Println("Settings updated")
+		cfg.prevSettings = settings
+		// only the latest settings matter, so replace the pending ones
+		select {
+		case <-cfg.settings:
+		default:
+		}
+		cfg.settings <- settings
+	}
+
+	newEntries := loader.entries()
 	up, down := cfg.getConfigChange(newEntries)
 	if len(up) > 0 || len(down) > 0 {
 		log.Println("Config updated")
 	}
 	cfg.prevEntries = newEntries
+	cfg.files = loader.files
 
 	go func() {
 		cfg.events <- append(up.toEvents(true), down.toEvents(false)...)
 	}()
 }
 
+// updateWatches (re)adds the given paths to the watcher and removes the ones no longer needed.
+// Watches are added again on every update, because editors often replace files instead of writing them.
+func (cfg *Config) updateWatches(watches map[string]bool) {
+	watches[cfg.path] = true
+	for path := range cfg.watches {
+		if !watches[path] {
+			cfg.watcher.Remove(path)
+		}
+	}
+	for path := range watches {
+		if err := cfg.watcher.Add(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Config file watch error:", err)
+		}
+	}
+	cfg.watches = watches
+}
+
 func (cfg *Config) getConfigChange(newEntries []ConfigEntry) (up, down configEntries) {
 	for _, newEntry := range newEntries {
 		if !configEntries(cfg.prevEntries).contains(newEntry) {
@@ -139,33 +337,24 @@ func (cfg *Config) getConfigChange(newEntries []ConfigEntry) (up, down configEnt
 	return
 }
 
-func ReadConfigFile(filename string) ([]ConfigEntry, error) {
-	file, err := os.Open(filename)
-	if err != nil {
+// ReadConfigFile reads the config at path, which can be a file or a directory
+func ReadConfigFile(path string) ([]ConfigEntry, error) {
+	loader := newConfigLoader(nil)
+	if err := loader.loadPath(path, nil); err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	return ReadConfig(file)
+	loader.logErrors()
+	return loader.entries(), nil
 }
 
+// ReadConfig reads config from reader. Include patterns are relative to the working directory.
 func ReadConfig(reader io.Reader) ([]ConfigEntry, error) {
-	r, err := executeTemplates(reader)
-	if err != nil {
+	loader := newConfigLoader(nil)
+	if err := loader.loadReader("config", reader); err != nil {
 		return nil, err
 	}
-
-	var config configLines
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line, err := readConfigLine(scanner.Text())
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		config = append(config, line)
-	}
-
-	return config.toConfigEntries(), scanner.Err()
+	loader.logErrors()
+	return loader.entries(), nil
 }
 
 func executeTemplates(reader io.Reader) (io.Reader, error) {
@@ -191,6 +380,7 @@ func executeTemplates(reader io.Reader) (io.Reader, error) {
 type configLine struct {
 	Hostnames []string
 	Targets   []url.URL
+	Options   Options
 }
 
 func readConfigLine(text string) (line configLine, err error) {
@@ -204,7 +394,14 @@ func readConfigLine(text string) (line configLine, err error) {
 		return
 	}
 	line.Hostnames = strings.Fields(items[0])
-	for _, target := range strings.Fields(items[1]) {
+	targets, options, hasOptions := splitOptions(items[1])
+	if hasOptions {
+		line.Options, err = parseOptions(options)
+		if err != nil {
+			return
+		}
+	}
+	for _, target := range strings.Fields(targets) {
 		targetURL, urlErr := url.Parse(target)
 		if urlErr != nil {
 			err = fmt.Errorf("cannot parse target url: %v", urlErr)
@@ -222,6 +419,7 @@ func (line configLine) toConfigEntries() []ConfigEntry {
 			entries = append(entries, ConfigEntry{
 				Hostname: hostname,
 				Target:   target,
+				Options:  line.Options,
 			})
 		}
 	}
@@ -241,7 +439,9 @@ type configEntries []ConfigEntry
 
 func (entries configEntries) contains(other ConfigEntry) bool {
 	for _, entry := range entries {
-		if entry.Hostname == other.Hostname && entry.Target.String() == other.Target.String() {
+		if entry.Hostname == other.Hostname &&
+			entry.Target.String() == other.Target.String() &&
+			entry.Options.Equal(other.Options) {
 			return true
 		}
 	}
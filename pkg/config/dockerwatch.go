@@ -6,12 +6,15 @@ import (
 	"log"
 	"net/url"
 	"strings"
+	"sync"
 
 	docker "github.com/fsouza/go-dockerclient"
 )
 
 type DockerWatch struct {
-	client *docker.Client
+	client     *docker.Client
+	mtx        sync.Mutex
+	containers map[string][]ConfigEntry
 }
 
 // NewDockerWatch returns a new DockerWatch
@@ -22,26 +25,75 @@ func NewDockerWatch() (*DockerWatch, error) {
 	}
 
 	d := &DockerWatch{
-		client: client,
+		client:     client,
+		containers: make(map[string][]ConfigEntry),
 	}
 	return d, nil
 }
 
 // GetActiveContainers returns up config events for active containers
 func (d *DockerWatch) GetActiveContainers() ([]ConfigEvent, error) {
-	containers, err := d.client.ListContainers(docker.ListContainersOptions{})
+	containers, err := d.scan()
 	if err != nil {
 		return nil, err
 	}
 
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
 	var results []ConfigEvent
+	for id, entries := range containers {
+		d.containers[id] = entries
+		results = append(results, configEntries(entries).toEvents(true)...)
+	}
+	return results, nil
+}
+
+// Rescan lists the active containers again and returns the changes since the last scan or event
+func (d *DockerWatch) Rescan() ([]ConfigEvent, error) {
+	containers, err := d.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	var up, down configEntries
+	for id, entries := range containers {
+		for _, entry := range entries {
+			if !configEntries(d.containers[id]).contains(entry) {
+				up = append(up, entry)
+			}
+		}
+	}
+	for id, entries := range d.containers {
+		for _, entry := range entries {
+			if !configEntries(containers[id]).contains(entry) {
+				down = append(down, entry)
+			}
+		}
+	}
+	d.containers = containers
+	return append(up.toEvents(true), down.toEvents(false)...), nil
+}
+
+func (d *DockerWatch) scan() (map[string][]ConfigEntry, error) {
+	containers, err := d.client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string][]ConfigEntry)
 	for _, container := range containers {
 		events, err := d.getContainerEvents(container.ID, true)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-		results = append(results, events...)
+		for _, event := range events {
+			results[container.ID] = append(results[container.ID], event.ConfigEntry)
+		}
 	}
 	return results, nil
 }
@@ -75,6 +127,7 @@ func (d *DockerWatch) convertEvents(in <-chan *docker.APIEvents, out chan<- []Co
 		if err != nil {
 			log.Println(err)
 		}
+		d.trackContainer(e.Actor.ID, events)
 		for _, event := range events {
 			out <- []ConfigEvent{event}
 		}
@@ -82,6 +135,23 @@ func (d *DockerWatch) convertEvents(in <-chan *docker.APIEvents, out chan<- []Co
 	close(out)
 }
 
+func (d *DockerWatch) trackContainer(id string, events []ConfigEvent) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	var entries []ConfigEntry
+	for _, event := range events {
+		if !event.Up {
+			delete(d.containers, id)
+			return
+		}
+		entries = append(entries, event.ConfigEntry)
+	}
+	if len(entries) > 0 {
+		d.containers[id] = entries
+	}
+}
+
 func (d *DockerWatch) getContainerEvents(id string, start bool) ([]ConfigEvent, error) {
 	cont, err := d.client.InspectContainerWithOptions(docker.InspectContainerOptions{
 		Context: context.Background(),
@@ -0,0 +1,366 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is an error at a specific location of the config
+type ConfigError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.File, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+type configFile struct {
+	entries      []ConfigEntry
+	includes     []string
+	listeners    []configListener
+	certificates []configCertificate
+}
+
+type configListener struct {
+	ListenerConfig
+	line int
+}
+
+type configCertificate struct {
+	CertificateConfig
+	line int
+}
+
+// configLoader reads config files, following include directives and directories.
+// If an included file cannot be read, its entries from the previous load are kept.
+type configLoader struct {
+	prevFiles map[string]*configFile
+	files     map[string]*configFile
+	order     []string
+	stack     []string
+	watches   map[string]bool
+	errors    []error
+}
+
+func newConfigLoader(prevFiles map[string]*configFile) *configLoader {
+	return &configLoader{
+		prevFiles: prevFiles,
+		files:     make(map[string]*configFile),
+		watches:   make(map[string]bool),
+	}
+}
+
+func (l *configLoader) loadPath(path string, parent *configFile) error {
+	path = filepath.Clean(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return l.loadDir(path, parent)
+	}
+	if parent != nil {
+		parent.includes = append(parent.includes, path)
+	}
+	return l.loadFile(path)
+}
+
+func (l *configLoader) loadDir(dir string, parent *configFile) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	l.watches[dir] = true
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !isConfigFileName(name) {
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		// Stat follows symlinks, like those of a sites-enabled directory
+		fi, err := os.Stat(filename)
+		if err != nil {
+			l.errors = append(l.errors, &ConfigError{File: filename, Err: err})
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if parent != nil {
+			parent.includes = append(parent.includes, filename)
+		}
+		if err := l.loadFile(filename); err != nil {
+			l.errors = append(l.errors, &ConfigError{File: filename, Err: err})
+		}
+	}
+	return nil
+}
+
+// isConfigFileName tells whether a file in a config directory is loaded by its extension,
+// so READMEs, backups and the like can be kept next to the config files
+func isConfigFileName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".conf", ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *configLoader) loadFile(filename string) error {
+	for _, f := range l.stack {
+		if f == filename {
+			return fmt.Errorf("include cycle")
+		}
+	}
+	if _, loaded := l.files[filename]; loaded {
+		return nil
+	}
+	l.watches[filename] = true
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if prev := l.prevFiles[filename]; prev != nil && !errors.Is(err, fs.ErrNotExist) {
+			l.errors = append(l.errors, &ConfigError{File: filename, Err: fmt.Errorf("%v (keeping previous routes)", err)})
+			l.keepFile(filename, prev)
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return l.loadReader(filename, file)
+}
+
+func (l *configLoader) loadReader(filename string, reader io.Reader) error {
+	r, err := executeTemplates(reader)
+	var root *yaml.Node
+	if err == nil && isStructured(filename) {
+		root, err = parseStructured(r)
+	}
+	if err != nil {
+		if prev := l.prevFiles[filename]; prev != nil {
+			l.errors = append(l.errors, &ConfigError{File: filename, Err: fmt.Errorf("%v (keeping previous routes)", err)})
+			l.keepFile(filename, prev)
+			return nil
+		}
+		return err
+	}
+
+	file := &configFile{}
+	l.files[filename] = file
+	l.order = append(l.order, filename)
+	l.stack = append(l.stack, filename)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	if root != nil {
+		l.loadStructured(filename, root, file)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		text := strings.TrimSpace(scanner.Text())
+		if pattern, ok := cutDirective(text, "include"); ok {
+			for _, err := range l.include(filepath.Dir(filename), pattern, file) {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: lineNum, Err: err})
+			}
+			continue
+		}
+		if args, ok := cutDirective(text, "listen"); ok {
+			l.listen(filename, lineNum, file, args)
+			continue
+		}
+		if args, ok := cutDirective(text, "certificate"); ok {
+			cert, err := readCertificateDirective(filepath.Dir(filename), args)
+			if err != nil {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: lineNum, Err: err})
+				continue
+			}
+			l.certificate(filename, lineNum, file, cert)
+			continue
+		}
+		line, err := readConfigLine(text)
+		if err != nil {
+			l.errors = append(l.errors, &ConfigError{File: filename, Line: lineNum, Err: err})
+			continue
+		}
+		line.Options.resolvePaths(filepath.Dir(filename))
+		for _, entry := range line.toConfigEntries() {
+			entry.file, entry.line = filename, lineNum
+			file.entries = append(file.entries, entry)
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *configLoader) include(dir, pattern string, parent *configFile) (errs []error) {
+	if len(pattern) == 0 {
+		return []error{fmt.Errorf("missing include pattern")}
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return []error{err}
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		// watch the directory of the pattern too, so new matching files are noticed
+		l.watches[globDir(pattern)] = true
+	} else if len(matches) == 0 {
+		l.watches[pattern] = true
+		return []error{fmt.Errorf("%s: %w", pattern, fs.ErrNotExist)}
+	}
+	sort.Strings(matches)
+	for _, match := range matches {
+		if err := l.loadPath(match, parent); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", match, err))
+		}
+	}
+	return
+}
+
+func (l *configLoader) listen(filename string, lineNum int, file *configFile, args string) {
+	listener, err := readListenDirective(args)
+	if err != nil {
+		l.errors = append(l.errors, &ConfigError{File: filename, Line: lineNum, Err: err})
+		return
+	}
+	file.listeners = append(file.listeners, configListener{ListenerConfig: listener, line: lineNum})
+}
+
+// certificate loads the files of a certificate and watches them, so changed certificates are reloaded.
+// If the files cannot be loaded, the certificate from the previous load is kept.
+func (l *configLoader) certificate(filename string, lineNum int, file *configFile, cert CertificateConfig) {
+	for _, path := range []string{cert.CertFile, cert.KeyFile, cert.ChainFile} {
+		if len(path) > 0 {
+			l.watches[path] = true
+		}
+	}
+	if err := cert.Load(); err != nil {
+		if prev := l.prevCertificate(filename, cert); prev != nil {
+			l.errors = append(l.errors, &ConfigError{File: filename, Line: lineNum, Err: fmt.Errorf("%v (keeping previous certificate)", err)})
+			file.certificates = append(file.certificates, configCertificate{CertificateConfig: *prev, line: lineNum})
+			return
+		}
+		l.errors = append(l.errors, &ConfigError{File: filename, Line: lineNum, Err: err})
+		return
+	}
+	file.certificates = append(file.certificates, configCertificate{CertificateConfig: cert, line: lineNum})
+}
+
+func (l *configLoader) prevCertificate(filename string, cert CertificateConfig) *CertificateConfig {
+	prev := l.prevFiles[filename]
+	if prev == nil {
+		return nil
+	}
+	for _, c := range prev.certificates {
+		if c.CertFile == cert.CertFile && c.KeyFile == cert.KeyFile && c.ChainFile == cert.ChainFile {
+			return &c.CertificateConfig
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) keepFile(filename string, prev *configFile) {
+	if _, loaded := l.files[filename]; loaded {
+		return
+	}
+	l.files[filename] = prev
+	l.order = append(l.order, filename)
+	for _, include := range prev.includes {
+		l.watches[include] = true
+		if prevInclude := l.prevFiles[include]; prevInclude != nil {
+			l.keepFile(include, prevInclude)
+		}
+	}
+}
+
+func (l *configLoader) entries() (entries []ConfigEntry) {
+	for _, filename := range l.order {
+		entries = append(entries, l.files[filename].entries...)
+	}
+	return
+}
+
+// settings returns the settings from all files. Listeners with an already used name or address are skipped,
+// and so are hostnames that already have a certificate.
+func (l *configLoader) settings() *Settings {
+	settings := &Settings{}
+	names := make(map[string]bool)
+	addrs := make(map[string]bool)
+	certHosts := make(map[string]bool)
+	for _, filename := range l.order {
+		for _, cert := range l.files[filename].certificates {
+			hostnames := make([]string, 0, len(cert.Hostnames))
+			for _, hostname := range cert.Hostnames {
+				if certHosts[hostname] {
+					l.errors = append(l.errors, &ConfigError{File: filename, Line: cert.line, Err: fmt.Errorf("duplicate certificate hostname: %s", hostname)})
+					continue
+				}
+				certHosts[hostname] = true
+				hostnames = append(hostnames, hostname)
+			}
+			cert.Hostnames = hostnames
+			settings.Certificates = append(settings.Certificates, cert.CertificateConfig)
+		}
+		for _, listener := range l.files[filename].listeners {
+			if names[listener.Name] {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: listener.line, Err: fmt.Errorf("duplicate listener name: %s", listener.Name)})
+				continue
+			}
+			if addrs[listener.Addr] {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: listener.line, Err: fmt.Errorf("duplicate listener address: %s", listener.Addr)})
+				continue
+			}
+			names[listener.Name] = true
+			addrs[listener.Addr] = true
+			settings.Listeners = append(settings.Listeners, listener.ListenerConfig)
+		}
+	}
+	return settings
+}
+
+func (l *configLoader) logErrors() {
+	for _, err := range l.errors {
+		log.Println(err)
+	}
+}
+
+func cutDirective(text, directive string) (string, bool) {
+	if !strings.HasPrefix(text, directive) || strings.Contains(text, "->") {
+		return "", false
+	}
+	rest := text[len(directive):]
+	if len(rest) > 0 && rest[0] != ' ' && rest[0] != '\t' {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+func globDir(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
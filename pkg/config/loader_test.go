@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLoadDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on windows")
+	}
+	root := t.TempDir()
+	available := filepath.Join(root, "sites-available")
+	enabled := filepath.Join(root, "sites-enabled")
+	for _, dir := range []string{available, enabled, filepath.Join(enabled, "nested.conf")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(available, "linked.conf"): "linked.com -> http://localhost:8081\n",
+		filepath.Join(enabled, "local.conf"):    "local.com -> http://localhost:8080\n",
+		filepath.Join(enabled, "api.yaml"):      "routes:\n  - hosts: [api.com]\n    targets: [http://localhost:8082]\n",
+		filepath.Join(enabled, "README"):        "readme.com -> http://localhost:9000\n",
+		filepath.Join(enabled, "old.conf.bak"):  "backup.com -> http://localhost:9001\n",
+		filepath.Join(enabled, "local.conf~"):   "editor.com -> http://localhost:9002\n",
+		filepath.Join(enabled, ".hidden.conf"):  "hidden.com -> http://localhost:9003\n",
+	}
+	for filename, text := range files {
+		if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(available, "linked.conf"), filepath.Join(enabled, "linked.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(available, "missing.conf"), filepath.Join(enabled, "broken.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	loader := newConfigLoader(nil)
+	if err := loader.loadPath(enabled, nil); err != nil {
+		t.Fatal(err)
+	}
+	var hosts []string
+	for _, entry := range loader.entries() {
+		hosts = append(hosts, entry.Hostname)
+	}
+	if got, want := strings.Join(hosts, " "), "api.com linked.com local.com"; got != want {
+		t.Errorf("loaded routes of %s, want %s", got, want)
+	}
+	if len(loader.errors) != 1 || !strings.Contains(loader.errors[0].Error(), "broken.conf") {
+		t.Errorf("errors: %v, want the broken symlink", loader.errors)
+	}
+	if !loader.watches[filepath.Join(enabled, "linked.conf")] {
+		t.Error("symlinked file is not watched")
+	}
+}
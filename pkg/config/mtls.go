@@ -0,0 +1,95 @@
+package config
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MTLSConfig is the client certificate authentication of a route from its mtls options
+type MTLSConfig struct {
+	CAFile   string
+	CAs      []*x509.Certificate
+	Required bool     // clients without a valid certificate are rejected, otherwise they are served without forwarded headers
+	Forward  []string // client certificate details forwarded to the backend: subject, fingerprint, pem
+}
+
+// NewMTLSConfig returns the mtls options of a route and loads its CA bundle, or nil if the route has no mtls options
+func NewMTLSConfig(opts Options) (*MTLSConfig, error) {
+	mtls := opts.Prefixed("mtls.")
+	if len(mtls) == 0 {
+		return nil, nil
+	}
+	cfg := &MTLSConfig{
+		CAFile:   mtls["ca"],
+		Required: true,
+		Forward:  []string{"subject", "fingerprint", "pem"},
+	}
+	for key, value := range mtls {
+		switch key {
+		case "ca":
+		case "mode":
+			switch value {
+			case "required":
+			case "optional":
+				cfg.Required = false
+			default:
+				return nil, fmt.Errorf("unknown mtls mode: %s", value)
+			}
+		case "forward":
+			cfg.Forward = opts.List("mtls.forward")
+			for _, field := range cfg.Forward {
+				switch field {
+				case "subject", "fingerprint", "pem":
+				case "none":
+					if len(cfg.Forward) > 1 {
+						return nil, fmt.Errorf("mtls.forward=none cannot be combined with other fields")
+					}
+				default:
+					return nil, fmt.Errorf("unknown mtls.forward field: %s", field)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown mtls option: mtls.%s", key)
+		}
+	}
+	if len(cfg.CAFile) == 0 {
+		return nil, fmt.Errorf("mtls options require mtls.ca")
+	}
+	data, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("mtls.ca: %v", err)
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("mtls.ca: %s: %v", cfg.CAFile, err)
+		}
+		cfg.CAs = append(cfg.CAs, ca)
+	}
+	if len(cfg.CAs) == 0 {
+		return nil, fmt.Errorf("mtls.ca: no certificates found in %s", cfg.CAFile)
+	}
+	return cfg, nil
+}
+
+// Pool returns the CA bundle as a certificate pool
+func (c *MTLSConfig) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, ca := range c.CAs {
+		pool.AddCert(ca)
+	}
+	return pool
+}
+
+// resolvePaths resolves the relative file paths in the options from dir, the directory of the config file
+func (o Options) resolvePaths(dir string) {
+	if path, ok := o["mtls.ca"]; ok && len(path) > 0 && !filepath.IsAbs(path) {
+		o["mtls.ca"] = filepath.Join(dir, path)
+	}
+}
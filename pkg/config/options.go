@@ -0,0 +1,211 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options contains per-route settings from the optional [key=value ...] block of a config line
+type Options map[string]string
+
+// Has returns whether the option is set
+func (o Options) Has(key string) bool {
+	_, ok := o[key]
+	return ok
+}
+
+// Get returns the value of an option or def if it is not set
+func (o Options) Get(key, def string) string {
+	if value, ok := o[key]; ok {
+		return value
+	}
+	return def
+}
+
+// Duration returns the value of an option as time.Duration or def if it is not set
+func (o Options) Duration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def, fmt.Errorf("option %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// Int returns the value of an option as int or def if it is not set
+func (o Options) Int(key string, def int) (int, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return def, fmt.Errorf("option %s: %v", key, err)
+	}
+	return i, nil
+}
+
+// Bool returns the value of an option as bool or def if it is not set.
+// An option without value (e.g. [nolog]) counts as true.
+func (o Options) Bool(key string, def bool) (bool, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	if len(value) == 0 {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def, fmt.Errorf("option %s: %v", key, err)
+	}
+	return b, nil
+}
+
+// List returns the comma separated values of an option
+func (o Options) List(key string) []string {
+	var values []string
+	for _, value := range strings.Split(o[key], ",") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Prefixed returns the options starting with prefix, with the prefix trimmed from the keys
+func (o Options) Prefixed(prefix string) map[string]string {
+	results := make(map[string]string)
+	for key, value := range o {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			results[key[len(prefix):]] = value
+		}
+	}
+	return results
+}
+
+// Equal returns whether two option sets contain the same keys and values
+func (o Options) Equal(other Options) bool {
+	if len(o) != len(other) {
+		return false
+	}
+	for key, value := range o {
+		if otherValue, ok := other[key]; !ok || otherValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Redacted is like String but replaces passwords with "xxxxx"
+func (o Options) Redacted() string {
+	auth, ok := o["auth"]
+	if !ok {
+		return o.String()
+	}
+	redacted := make(Options, len(o))
+	for key, value := range o {
+		redacted[key] = value
+	}
+	// auth is <method>:<user>:<password>, and the password may contain ':' too
+	method, credentials, _ := strings.Cut(auth, ":")
+	if user, _, ok := strings.Cut(credentials, ":"); ok {
+		redacted["auth"] = method + ":" + user + ":xxxxx"
+	}
+	return redacted.String()
+}
+
+func (o Options) String() string {
+	if len(o) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(o))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := o[key]
+		switch {
+		case len(value) == 0:
+			items = append(items, key)
+		case strings.ContainsAny(value, " \t\"]"):
+			items = append(items, key+"="+strconv.Quote(value))
+		default:
+			items = append(items, key+"="+value)
+		}
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+// splitOptions splits the trailing options block from the targets part of a config line
+func splitOptions(text string) (targets, options string, hasOptions bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasSuffix(text, "]") {
+		return text, "", false
+	}
+	// the block has to start at a field boundary, so IPv6 targets like http://[::1] are left alone
+	for i := strings.LastIndex(text, "["); i >= 0; i = strings.LastIndex(text[:i], "[") {
+		if i == 0 || text[i-1] == ' ' || text[i-1] == '\t' {
+			return strings.TrimSpace(text[:i]), text[i+1 : len(text)-1], true
+		}
+	}
+	return text, "", false
+}
+
+func parseOptions(text string) (Options, error) {
+	fields, err := splitQuotedFields(text)
+	if err != nil {
+		return nil, err
+	}
+	options := make(Options, len(fields))
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		if len(key) == 0 {
+			return nil, fmt.Errorf("bad option: %s", field)
+		}
+		if strings.HasPrefix(value, "\"") {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("bad option value: %s", field)
+			}
+		}
+		options[key] = value
+	}
+	return options, nil
+}
+
+func splitQuotedFields(text string) (fields []string, err error) {
+	var field strings.Builder
+	var quoted, escaped bool
+	for _, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t'):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(r)
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in options: %s", text)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return
+}
@@ -0,0 +1,22 @@
+package config
+
+import "testing"
+
+func TestOptionsRedacted(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want string
+	}{
+		{Options{"auth": "basic:admin:secret"}, "[auth=basic:admin:xxxxx]"},
+		{Options{"auth": "basic:admin:pa:ss"}, "[auth=basic:admin:xxxxx]"},
+		{Options{"auth": "basic:admin::"}, "[auth=basic:admin:xxxxx]"},
+		{Options{"auth": "basic:admin:secret", "timeout": "30s"}, "[auth=basic:admin:xxxxx timeout=30s]"},
+		{Options{"auth": "basic:admin"}, "[auth=basic:admin]"},
+		{Options{"timeout": "30s"}, "[timeout=30s]"},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.Redacted(); got != tt.want {
+			t.Errorf("%v: got %s, want %s", map[string]string(tt.opts), got, tt.want)
+		}
+	}
+}
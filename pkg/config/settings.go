@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Settings are the server-wide settings defined by config directives
+type Settings struct {
+	Listeners    []ListenerConfig
+	Certificates []CertificateConfig
+}
+
+// ListenerConfig is an HTTP or HTTPS listener
+type ListenerConfig struct {
+	Name     string
+	Protocol string
+	Addr     string
+	Redirect bool // redirect HTTP requests to HTTPS instead of serving routes
+}
+
+// Equal returns whether the settings are the same
+func (s *Settings) Equal(other *Settings) bool {
+	return slices.Equal(s.Listeners, other.Listeners) &&
+		slices.EqualFunc(s.Certificates, other.Certificates, CertificateConfig.Equal)
+}
+
+func (l ListenerConfig) String() string {
+	return fmt.Sprintf("%s (%s://%s)", l.Name, l.Protocol, l.Addr)
+}
+
+// NewListenerConfig returns a listener config with the given protocol, address and options.
+// Supported options are name (defaults to protocol-addr) and redirect.
+func NewListenerConfig(protocol, addr string, opts Options) (l ListenerConfig, err error) {
+	switch protocol {
+	case "http", "https":
+	default:
+		err = fmt.Errorf("unknown listener protocol: %s", protocol)
+		return
+	}
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		return
+	}
+	for key := range opts {
+		switch key {
+		case "name", "redirect":
+		default:
+			err = fmt.Errorf("unknown listener option: %s", key)
+			return
+		}
+	}
+	l.Name = opts.Get("name", protocol+"-"+addr)
+	l.Protocol = protocol
+	l.Addr = addr
+	l.Redirect, err = opts.Bool("redirect", false)
+	return
+}
+
+// readListenDirective parses the arguments of a listen directive: <http|https> <addr> [options]
+func readListenDirective(text string) (ListenerConfig, error) {
+	args, options, hasOptions := splitOptions(text)
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return ListenerConfig{}, fmt.Errorf("bad listen directive, expected: listen <http|https> <addr> [options]")
+	}
+	var opts Options
+	if hasOptions {
+		var err error
+		if opts, err = parseOptions(options); err != nil {
+			return ListenerConfig{}, err
+		}
+	}
+	return NewListenerConfig(fields[0], fields[1], opts)
+}
@@ -0,0 +1,316 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// structuredConfig is the YAML/JSON representation of a config file
+type structuredConfig struct {
+	Include      []string                `yaml:"include,omitempty" json:"include,omitempty"`
+	Listen       []structuredListener    `yaml:"listen,omitempty" json:"listen,omitempty"`
+	Certificates []structuredCertificate `yaml:"certificates,omitempty" json:"certificates,omitempty"`
+	Routes       []structuredRoute       `yaml:"routes" json:"routes"`
+}
+
+type structuredListener struct {
+	Protocol string `yaml:"protocol" json:"protocol"`
+	Addr     string `yaml:"addr" json:"addr"`
+	Name     string `yaml:"name,omitempty" json:"name,omitempty"`
+	Redirect bool   `yaml:"redirect,omitempty" json:"redirect,omitempty"`
+}
+
+type structuredCertificate struct {
+	Cert  string   `yaml:"cert" json:"cert"`
+	Key   string   `yaml:"key" json:"key"`
+	Chain string   `yaml:"chain,omitempty" json:"chain,omitempty"`
+	Hosts []string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
+type structuredRoute struct {
+	Hosts   []string               `yaml:"hosts" json:"hosts"`
+	Targets []string               `yaml:"targets" json:"targets"`
+	Options map[string]interface{} `yaml:"options,omitempty" json:"options,omitempty"`
+}
+
+// isStructured returns whether a config file is in YAML or JSON format based on its extension
+func isStructured(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+func parseStructured(reader io.Reader) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(reader).Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: config has to be a mapping", root.Line)
+	}
+	return root, nil
+}
+
+func (l *configLoader) loadStructured(filename string, root *yaml.Node, file *configFile) {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "include":
+			var patterns []string
+			if value.Kind == yaml.ScalarNode {
+				patterns = []string{value.Value}
+			} else if err := value.Decode(&patterns); err != nil {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: value.Line, Err: err})
+				continue
+			}
+			for _, pattern := range patterns {
+				for _, err := range l.include(filepath.Dir(filename), pattern, file) {
+					l.errors = append(l.errors, &ConfigError{File: filename, Line: value.Line, Err: err})
+				}
+			}
+		case "listen":
+			if value.Kind != yaml.SequenceNode {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: value.Line, Err: fmt.Errorf("listen has to be a list")})
+				continue
+			}
+			for _, listenerNode := range value.Content {
+				listener, err := readStructuredListener(listenerNode)
+				if err != nil {
+					l.errors = append(l.errors, &ConfigError{File: filename, Line: listenerNode.Line, Err: err})
+					continue
+				}
+				file.listeners = append(file.listeners, configListener{ListenerConfig: listener, line: listenerNode.Line})
+			}
+		case "certificates":
+			if value.Kind != yaml.SequenceNode {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: value.Line, Err: fmt.Errorf("certificates has to be a list")})
+				continue
+			}
+			for _, certNode := range value.Content {
+				var cert structuredCertificate
+				if err := certNode.Decode(&cert); err != nil {
+					l.errors = append(l.errors, &ConfigError{File: filename, Line: certNode.Line, Err: err})
+					continue
+				}
+				if len(cert.Cert) == 0 || len(cert.Key) == 0 {
+					l.errors = append(l.errors, &ConfigError{File: filename, Line: certNode.Line, Err: fmt.Errorf("certificate needs cert and key")})
+					continue
+				}
+				l.certificate(filename, certNode.Line, file, newCertificateConfig(filepath.Dir(filename), cert.Cert, cert.Key, cert.Chain, cert.Hosts))
+			}
+		case "routes":
+			if value.Kind != yaml.SequenceNode {
+				l.errors = append(l.errors, &ConfigError{File: filename, Line: value.Line, Err: fmt.Errorf("routes has to be a list")})
+				continue
+			}
+			for _, routeNode := range value.Content {
+				line, err := readStructuredRoute(routeNode)
+				if err != nil {
+					l.errors = append(l.errors, &ConfigError{File: filename, Line: routeNode.Line, Err: err})
+					continue
+				}
+				line.Options.resolvePaths(filepath.Dir(filename))
+				for _, entry := range line.toConfigEntries() {
+					entry.file, entry.line = filename, routeNode.Line
+					file.entries = append(file.entries, entry)
+				}
+			}
+		default:
+			l.errors = append(l.errors, &ConfigError{File: filename, Line: key.Line, Err: fmt.Errorf("unknown key: %s", key.Value)})
+		}
+	}
+}
+
+func readStructuredRoute(node *yaml.Node) (line configLine, err error) {
+	var route structuredRoute
+	if err = node.Decode(&route); err != nil {
+		return
+	}
+	if len(route.Hosts) == 0 || len(route.Targets) == 0 {
+		err = fmt.Errorf("route needs hosts and targets")
+		return
+	}
+	line.Hostnames = route.Hosts
+	for _, target := range route.Targets {
+		targetURL, urlErr := url.Parse(target)
+		if urlErr != nil {
+			err = fmt.Errorf("cannot parse target url: %v", urlErr)
+			return
+		}
+		line.Targets = append(line.Targets, *targetURL)
+	}
+	if len(route.Options) > 0 {
+		line.Options = make(Options)
+		flattenOptions(line.Options, "", route.Options)
+	}
+	return
+}
+
+func readStructuredListener(node *yaml.Node) (ListenerConfig, error) {
+	var listener structuredListener
+	if err := node.Decode(&listener); err != nil {
+		return ListenerConfig{}, err
+	}
+	opts := make(Options)
+	if len(listener.Name) > 0 {
+		opts["name"] = listener.Name
+	}
+	if listener.Redirect {
+		opts["redirect"] = "true"
+	}
+	return NewListenerConfig(listener.Protocol, listener.Addr, opts)
+}
+
+// flattenOptions converts nested options like {header: {X-Foo: bar}} to header.X-Foo=bar
+func flattenOptions(options Options, prefix string, values map[string]interface{}) {
+	for key, value := range values {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenOptions(options, prefix+key+".", value)
+		case []interface{}:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			options[prefix+key] = strings.Join(items, ",")
+		case nil:
+			options[prefix+key] = ""
+		default:
+			options[prefix+key] = fmt.Sprint(value)
+		}
+	}
+}
+
+// nestOptions is the reverse of flattenOptions
+func nestOptions(options Options) map[string]interface{} {
+	results := make(map[string]interface{})
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var value interface{} = options[key]
+		if value == "" {
+			value = nil // options without value (like match.header.X-Canary) are loaded back as empty strings
+		}
+		group, subkey, nested := strings.Cut(key, ".")
+		if !nested {
+			results[key] = value
+			continue
+		}
+		if groupMap, ok := results[group].(map[string]interface{}); ok {
+			groupMap[subkey] = value
+		} else if _, exists := results[group]; !exists {
+			results[group] = map[string]interface{}{subkey: value}
+		} else {
+			results[key] = value
+		}
+	}
+	return results
+}
+
+// ConvertConfig converts a config in line format to the structured YAML or JSON format.
+// Templates are executed and include directives are kept as they are.
+func ConvertConfig(reader io.Reader, format string) ([]byte, error) {
+	r, err := executeTemplates(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg structuredConfig
+	var errs []string
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		text := strings.TrimSpace(scanner.Text())
+		if pattern, ok := cutDirective(text, "include"); ok {
+			cfg.Include = append(cfg.Include, pattern)
+			continue
+		}
+		if args, ok := cutDirective(text, "listen"); ok {
+			listener, err := readListenDirective(args)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("line %d: %v", lineNum, err))
+				continue
+			}
+			structured := structuredListener{
+				Protocol: listener.Protocol,
+				Addr:     listener.Addr,
+				Redirect: listener.Redirect,
+			}
+			if listener.Name != listener.Protocol+"-"+listener.Addr {
+				structured.Name = listener.Name
+			}
+			cfg.Listen = append(cfg.Listen, structured)
+			continue
+		}
+		if args, ok := cutDirective(text, "certificate"); ok {
+			cert, err := readCertificateDirective("", args)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("line %d: %v", lineNum, err))
+				continue
+			}
+			cfg.Certificates = append(cfg.Certificates, structuredCertificate{
+				Cert:  cert.CertFile,
+				Key:   cert.KeyFile,
+				Chain: cert.ChainFile,
+				Hosts: cert.Hostnames,
+			})
+			continue
+		}
+		line, err := readConfigLine(text)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %v", lineNum, err))
+			continue
+		}
+		if len(line.Hostnames) == 0 || len(line.Targets) == 0 {
+			continue
+		}
+		route := structuredRoute{Hosts: line.Hostnames}
+		for _, target := range line.Targets {
+			route.Targets = append(route.Targets, target.String())
+		}
+		if len(line.Options) > 0 {
+			route.Options = nestOptions(line.Options)
+		}
+		cfg.Routes = append(cfg.Routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+
+	switch format {
+	case "json":
+		return json.MarshalIndent(&cfg, "", "  ")
+	case "yaml", "yml":
+		var out bytes.Buffer
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		if err := enc.Encode(&cfg); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), enc.Close()
+	default:
+		return nil, fmt.Errorf("unknown config format: %s", format)
+	}
+}
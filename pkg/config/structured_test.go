@@ -0,0 +1,71 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, filename, text string) []ConfigEntry {
+	t.Helper()
+	loader := newConfigLoader(nil)
+	if err := loader.loadReader(filename, strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	if len(loader.errors) > 0 {
+		t.Fatal(loader.errors)
+	}
+	return loader.entries()
+}
+
+func TestConvertConfigKeepsOptions(t *testing.T) {
+	const text = `canary.com -> http://localhost:8081 [match.header.X-Canary match.query.debug nolog]
+canary.com -> http://localhost:8080 [timeout=30s header.X-Frame-Options=DENY match.header.X-Env=prod,staging]
+flags.com -> http://localhost:8082 [failover.retry=false health.path=/healthz lb.sticky]
+`
+	want := loadTestConfig(t, "config", text)
+	for _, format := range []string{"yaml", "json"} {
+		converted, err := ConvertConfig(strings.NewReader(text), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := loadTestConfig(t, "config."+format, string(converted))
+		if len(got) != len(want) {
+			t.Fatalf("%s: %d entries, want %d", format, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].ID() != want[i].ID() {
+				t.Errorf("%s: entry %s, want %s\n%s", format, got[i].ID(), want[i].ID(), converted)
+			}
+		}
+	}
+}
+
+func TestStructuredNullOption(t *testing.T) {
+	entries := loadTestConfig(t, "config.yaml", `routes:
+  - hosts: [canary.com]
+    targets: [http://localhost:8081]
+    options:
+      match:
+        header:
+          X-Canary: null
+        query:
+          debug:
+`)
+	opts := entries[0].Options
+	if value, ok := opts["match.header.X-Canary"]; !ok || value != "" {
+		t.Errorf("match.header.X-Canary = %q, %v, want empty value", value, ok)
+	}
+	if value, ok := opts["match.query.debug"]; !ok || value != "" {
+		t.Errorf("match.query.debug = %q, %v, want empty value", value, ok)
+	}
+	m, err := entries[0].Matcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, ok := m.Headers["X-Canary"]; !ok || len(values) != 0 {
+		t.Errorf("X-Canary is not a presence check: %q", values)
+	}
+	if values, ok := m.Query["debug"]; !ok || len(values) != 0 {
+		t.Errorf("debug is not a presence check: %q", values)
+	}
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/razzie/razvhost/pkg/mux"
+)
+
+// IsTemplate tells whether the target of the entry refers to captures of its regexp hostname or path
+func (e ConfigEntry) IsTemplate() bool {
+	host, path := mux.SplitRoute(e.Hostname)
+	if !strings.HasPrefix(host, "~") && !strings.HasPrefix(path, "/~") {
+		return false
+	}
+	return strings.Contains(e.Target.Host+e.Target.Path+e.Target.RawQuery, "$")
+}
+
+// captureNames compiles the regexp hostname and path of the entry, and returns the names and indexes
+// of their capture groups
+func (e ConfigEntry) captureNames() (map[string]string, error) {
+	host, path := mux.SplitRoute(e.Hostname)
+	var patterns []string
+	if strings.HasPrefix(host, "~") {
+		patterns = append(patterns, host[1:])
+	}
+	if strings.HasPrefix(path, "/~") {
+		patterns = append(patterns, path[2:])
+	}
+	captures := make(map[string]string)
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad regexp: %v", err)
+		}
+		for i, name := range re.SubexpNames()[1:] {
+			captures[strconv.Itoa(i+1)] = name
+			if len(name) > 0 {
+				captures[name] = name
+			}
+		}
+	}
+	return captures, nil
+}
+
+// CheckTemplate reports bad regexps in the hostname of the entry and unknown captures in its target
+func (e ConfigEntry) CheckTemplate() error {
+	captures, err := e.captureNames()
+	if err != nil || !e.IsTemplate() {
+		return err
+	}
+	_, err = ExpandTarget(e.Target, captures)
+	return err
+}
+
+// ExpandTarget substitutes $name and ${name} in the host, path and query of a target URL with captures of a regexp route.
+// Captures cannot inject other URL components or path traversal into the target.
+func ExpandTarget(target url.URL, captures map[string]string) (url.URL, error) {
+	var err error
+	expand := func(s string, escape func(string) (string, error)) string {
+		return os.Expand(s, func(name string) string {
+			value, ok := captures[name]
+			if !ok {
+				err = fmt.Errorf("unknown capture in target: $%s", name)
+				return ""
+			}
+			value, escapeErr := escape(value)
+			if escapeErr != nil && err == nil {
+				err = escapeErr
+			}
+			return value
+		})
+	}
+	target.Host = expand(target.Host, hostCapture)
+	target.Path = expand(target.Path, pathCapture)
+	target.RawPath = ""
+	target.RawQuery = expand(target.RawQuery, func(value string) (string, error) {
+		return url.QueryEscape(value), nil
+	})
+	return target, err
+}
+
+func hostCapture(value string) (string, error) {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return "", fmt.Errorf("bad capture value in hostname: %s", value)
+		}
+	}
+	return value, nil
+}
+
+func pathCapture(value string) (string, error) {
+	for _, segment := range strings.FieldsFunc(value, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if segment == ".." {
+			return "", fmt.Errorf("bad capture value in path: %s", value)
+		}
+	}
+	return value, nil
+}
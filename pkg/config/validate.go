@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/razzie/razvhost/pkg/mux"
+)
+
+// Validator checks config entries without serving them
+type Validator interface {
+	IsKnownScheme(scheme string) bool
+	ValidateEntry(entry ConfigEntry) error
+}
+
+// ValidationResult contains the entries and problems found by Validate
+type ValidationResult struct {
+	Entries  []ConfigEntry
+	Errors   []error
+	Warnings []error
+}
+
+// Validate reads the config at path and reports every problem with file name and line number.
+// Each entry with a known scheme is dry-run by validator.
+func Validate(path string, validator Validator) *ValidationResult {
+	result := &ValidationResult{}
+	loader := newConfigLoader(nil)
+	if err := loader.loadPath(path, nil); err != nil {
+		result.Errors = append(result.Errors, &ConfigError{File: path, Err: err})
+		return result
+	}
+	loader.settings()
+	result.Errors = append(result.Errors, loader.errors...)
+	result.Entries = loader.entries()
+
+	var routes mux.Mux
+	var paths []string
+	seen := make(map[string]ConfigEntry)
+	warned := make(map[string]bool)
+	for _, entry := range result.Entries {
+		if !validator.IsKnownScheme(entry.Target.Scheme) {
+			if key := entry.location() + " " + entry.Target.String(); !warned[key] {
+				result.Warnings = append(result.Warnings, entry.errorf("unknown target URL scheme: %s", entry.Target.Scheme))
+				warned[key] = true
+			}
+		} else if err := validator.ValidateEntry(entry); err != nil {
+			result.Errors = append(result.Errors, entry.errorf("%s: %v", entry.String(), err))
+		}
+		if _, err := entry.Backend(); err != nil {
+			result.Errors = append(result.Errors, entry.errorf("%s: %v", entry.String(), err))
+		}
+		if err := entry.CheckTemplate(); err != nil {
+			result.Errors = append(result.Errors, entry.errorf("%s: %v", entry.String(), err))
+		}
+		if _, err := entry.CertAllow(); err != nil {
+			result.Errors = append(result.Errors, entry.errorf("%s: %v", entry.String(), err))
+		}
+
+		if first, ok := seen[entry.Hostname]; ok {
+			conditional := len(entry.Options.Prefixed("match.")) > 0 || len(first.Options.Prefixed("match.")) > 0
+			if loc := entry.location(); loc != first.location() && !conditional && !warned[entry.Hostname+" "+loc] {
+				result.Warnings = append(result.Warnings, entry.errorf("duplicate hostname %s (first defined at %s)", entry.Hostname, first.location()))
+				warned[entry.Hostname+" "+loc] = true
+			}
+			continue
+		}
+		seen[entry.Hostname] = entry
+		routes.Add(entry.Hostname, nil, "")
+		paths = append(paths, entry.Hostname)
+	}
+
+	for _, path := range paths {
+		if other, shadowed := routes.ShadowedBy(path); shadowed {
+			entry := seen[path]
+			result.Warnings = append(result.Warnings, entry.errorf("%s is unreachable, because %s is matched first", path, other))
+		}
+	}
+
+	return result
+}
+
+func (e *ConfigEntry) errorf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if len(e.file) == 0 {
+		return err
+	}
+	return &ConfigError{File: e.file, Line: e.line, Err: err}
+}
+
+func (e *ConfigEntry) location() string {
+	if len(e.file) == 0 {
+		return "unknown location"
+	}
+	return fmt.Sprintf("%s:%d", e.file, e.line)
+}
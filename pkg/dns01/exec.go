@@ -0,0 +1,45 @@
+package dns01
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// execProvider runs a hook command as `<command> present|cleanup <fqdn> <value>`
+// to manage the records with any DNS API
+type execProvider struct {
+	command string
+}
+
+func newExecProvider(u *url.URL) (*execProvider, error) {
+	command := u.Host + u.Path
+	if len(u.Opaque) > 0 {
+		command = u.Opaque
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("exec DNS provider requires a command, e.g. exec:///path/to/hook")
+	}
+	return &execProvider{command: command}, nil
+}
+
+func (p *execProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *execProvider) run(ctx context.Context, action, fqdn, value string) error {
+	output, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); len(msg) > 0 {
+			return fmt.Errorf("%s %s: %v: %s", p.command, action, err, msg)
+		}
+		return fmt.Errorf("%s %s: %v", p.command, action, err)
+	}
+	return nil
+}
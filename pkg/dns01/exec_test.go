@@ -0,0 +1,96 @@
+package dns01
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// writeHook writes a shell script hook to a temporary directory
+func writeHook(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts need a POSIX shell")
+	}
+	hook := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func TestExecProvider(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "hook.log")
+	hook := writeHook(t, `echo "$#|$1|$2|$3" >> "`+log+`"`+"\n")
+	p, err := NewProvider("exec://" + hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.example.com.", "value with spaces"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.example.com.", "value with spaces"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "3|present|_acme-challenge.example.com.|value with spaces\n" +
+		"3|cleanup|_acme-challenge.example.com.|value with spaces\n"
+	if string(data) != want {
+		t.Errorf("hook calls:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestExecProviderErrors(t *testing.T) {
+	hook := writeHook(t, "echo \"cannot reach the DNS API\" >&2\nexit 3\n")
+	p, _ := NewProvider("exec://" + hook)
+	err := p.Present(context.Background(), "_acme-challenge.example.com.", "value")
+	if err == nil || !strings.Contains(err.Error(), "present: exit status 3: cannot reach the DNS API") {
+		t.Errorf("error: %v, want the exit status and the output of the hook", err)
+	}
+
+	p, _ = NewProvider("exec://" + filepath.Join(t.TempDir(), "missing"))
+	if err := p.CleanUp(context.Background(), "_acme-challenge.example.com.", "value"); err == nil {
+		t.Error("no error for a missing hook")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, _ = NewProvider("exec://" + writeHook(t, "sleep 10\n"))
+	if err := p.Present(ctx, "_acme-challenge.example.com.", "value"); err == nil {
+		t.Error("no error for a canceled context")
+	}
+}
+
+func TestNewExecProvider(t *testing.T) {
+	tests := map[string]string{
+		"exec:///usr/local/bin/dns-hook": "/usr/local/bin/dns-hook",
+		"exec:hooks/dns-hook":            "hooks/dns-hook",
+		"exec://dns-hook":                "dns-hook",
+	}
+	for providerURL, want := range tests {
+		p, err := newExecProvider(mustParseURL(t, providerURL))
+		if err != nil {
+			t.Errorf("%s: %v", providerURL, err)
+		} else if p.command != want {
+			t.Errorf("%s: command %s, want %s", providerURL, p.command, want)
+		}
+	}
+	if _, err := NewProvider("exec://"); err == nil {
+		t.Error("no error for a missing command")
+	}
+}
@@ -0,0 +1,272 @@
+package dns01
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeSOA   = 6
+	dnsTypeTXT   = 16
+	dnsTypeTSIG  = 250
+	dnsClassIN   = 1
+	dnsClassNone = 254
+	dnsClassAny  = 255
+	dnsOpUpdate  = 5
+	tsigFudge    = 300
+)
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha384": sha512.New384,
+	"hmac-sha512": sha512.New,
+}
+
+var dnsRcodes = map[byte]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+// rfc2136Provider sends dynamic updates (RFC 2136) over TCP to an authoritative name server,
+// signed with a TSIG key (RFC 8945) if one is given
+type rfc2136Provider struct {
+	server    string
+	zones     []string
+	ttl       uint32
+	keyName   string
+	secret    []byte
+	algorithm string
+	hash      func() hash.Hash
+}
+
+func newRFC2136Provider(u *url.URL) (*rfc2136Provider, error) {
+	p := &rfc2136Provider{
+		server:    u.Host,
+		ttl:       60,
+		algorithm: "hmac-sha256",
+	}
+	if len(u.Port()) == 0 {
+		p.server = net.JoinHostPort(u.Hostname(), "53")
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("rfc2136 DNS provider requires a name server, e.g. rfc2136://ns.example.com")
+	}
+	query := u.Query()
+	for _, zone := range strings.Split(query.Get("zone"), ",") {
+		if zone = strings.ToLower(strings.Trim(strings.TrimSpace(zone), ".")); len(zone) > 0 {
+			p.zones = append(p.zones, zone)
+		}
+	}
+	if ttl := query.Get("ttl"); len(ttl) > 0 {
+		value, err := strconv.ParseUint(ttl, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad ttl: %s", ttl)
+		}
+		p.ttl = uint32(value)
+	}
+	if algorithm := query.Get("algorithm"); len(algorithm) > 0 {
+		p.algorithm = strings.ToLower(strings.TrimSuffix(algorithm, "."))
+	}
+	if u.User != nil {
+		secret, _ := u.User.Password()
+		key, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("bad TSIG secret: %v", err)
+		}
+		p.keyName = strings.ToLower(strings.TrimSuffix(u.User.Username(), "."))
+		p.secret = key
+		if p.hash = tsigAlgorithms[p.algorithm]; p.hash == nil {
+			return nil, fmt.Errorf("unknown TSIG algorithm: %s", p.algorithm)
+		}
+	}
+	return p, nil
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, dnsClassIN, p.ttl)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, dnsClassNone, 0)
+}
+
+// zone returns the longest configured zone containing fqdn, or the parent domain of fqdn if no zone contains it
+func (p *rfc2136Provider) zone(fqdn string) string {
+	name := strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	zone := ""
+	for _, z := range p.zones {
+		if (name == z || strings.HasSuffix(name, "."+z)) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	if len(zone) == 0 {
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			zone = name[i+1:]
+		}
+	}
+	return zone
+}
+
+// update adds (class IN) or deletes (class NONE) a TXT record
+func (p *rfc2136Provider) update(ctx context.Context, fqdn, value string, class uint16, ttl uint32) error {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsOpUpdate<<11)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // zone
+	msg = binary.BigEndian.AppendUint16(msg, 0) // prerequisites
+	msg = binary.BigEndian.AppendUint16(msg, 1) // updates
+	msg = binary.BigEndian.AppendUint16(msg, 0) // additional records
+
+	var err error
+	if msg, err = appendName(msg, p.zone(fqdn)); err != nil {
+		return err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	if len(value) > 255 {
+		return fmt.Errorf("TXT record value too long: %d bytes", len(value))
+	}
+	rdata := append([]byte{byte(len(value))}, value...)
+	if msg, err = appendRecord(msg, fqdn, dnsTypeTXT, class, ttl, rdata); err != nil {
+		return err
+	}
+	if len(p.secret) > 0 {
+		if msg, err = p.sign(msg, id); err != nil {
+			return err
+		}
+	}
+	return p.exchange(ctx, msg, id)
+}
+
+// sign appends a TSIG record to msg
+func (p *rfc2136Provider) sign(msg []byte, id uint16) ([]byte, error) {
+	now := uint64(time.Now().Unix())
+	vars, err := appendName(nil, p.keyName)
+	if err != nil {
+		return nil, err
+	}
+	vars = binary.BigEndian.AppendUint16(vars, dnsClassAny)
+	vars = binary.BigEndian.AppendUint32(vars, 0) // TTL
+	if vars, err = appendName(vars, p.algorithm); err != nil {
+		return nil, err
+	}
+	vars = binary.BigEndian.AppendUint16(vars, uint16(now>>32))
+	vars = binary.BigEndian.AppendUint32(vars, uint32(now))
+	vars = binary.BigEndian.AppendUint16(vars, tsigFudge)
+	vars = binary.BigEndian.AppendUint16(vars, 0) // error
+	vars = binary.BigEndian.AppendUint16(vars, 0) // other data length
+
+	mac := hmac.New(p.hash, p.secret)
+	mac.Write(msg)
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rdata, _ := appendName(nil, p.algorithm)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(now>>32))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(now))
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // error
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // other data length
+
+	if msg, err = appendRecord(msg, p.keyName, dnsTypeTSIG, dnsClassAny, 0, rdata); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(msg[10:], 1) // additional records
+	return msg, nil
+}
+
+func (p *rfc2136Provider) exchange(ctx context.Context, msg []byte, id uint16) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp) != id || resp[2]&0x80 == 0 {
+		return fmt.Errorf("%s: bad DNS update response", p.server)
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 {
+		name, ok := dnsRcodes[rcode]
+		if !ok {
+			name = fmt.Sprintf("rcode %d", rcode)
+		}
+		return fmt.Errorf("%s: DNS update failed: %s", p.server, name)
+	}
+	return nil
+}
+
+// appendName appends a domain name in uncompressed, lowercase wire format
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if len(name) > 0 {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("bad domain name: %s", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+func appendRecord(b []byte, name string, typ, class uint16, ttl uint32, rdata []byte) ([]byte, error) {
+	b, err := appendName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...), nil
+}
@@ -7,29 +7,64 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/razzie/razvhost/pkg/config"
 	"github.com/yookoala/gofast"
 )
 
 type HandlerFactory struct {
 	phpClientFactory gofast.ClientFactory
+	upstream         UpstreamConfig
+	transports       transportCache
 }
 
 // NewHandlerFactory returns a new HandlerFactory
-func NewHandlerFactory(phpaddr *url.URL) *HandlerFactory {
-	hf := &HandlerFactory{}
+func NewHandlerFactory(phpaddr *url.URL, upstream UpstreamConfig) *HandlerFactory {
+	hf := &HandlerFactory{upstream: upstream}
 	if phpaddr != nil {
 		hf.phpClientFactory = setupPHP(phpaddr)
 	}
 	return hf
 }
 
-func (hf *HandlerFactory) Handler(hostname string, target url.URL) (handler http.Handler, err error) {
-	hostname, hostPath := splitHostnameAndPath(hostname)
+// Handler returns a new handler for the given route and target, wrapped by the route options.
+// If the returned handler implements io.Closer, it has to be closed when the route is removed.
+// Regexp routes whose target refers to captures get a handler for each expanded target on first use.
+func (hf *HandlerFactory) Handler(hostname string, target url.URL, opts config.Options) (http.Handler, error) {
+	entry := config.ConfigEntry{Hostname: hostname, Target: target, Options: opts}
+	if entry.IsTemplate() {
+		if err := hf.validateTemplate(entry); err != nil {
+			return nil, err
+		}
+		return newTemplateHandler(hf, hostname, target, opts), nil
+	}
+	return hf.build(hostname, target, opts, false)
+}
+
+func (hf *HandlerFactory) build(route string, target url.URL, opts config.Options, dryRun bool) (handler http.Handler, err error) {
+	health, err := newHealthCheckConfig(opts)
+	if err != nil {
+		return
+	}
+	limiter, err := newConnLimiter(opts)
+	if err != nil {
+		return
+	}
+	hostname, hostPath := splitHostnameAndPath(route)
+	var transport http.RoundTripper
 	switch target.Scheme {
 	case "file":
 		handler = newFileServer(hostname, hostPath, target.Host+target.Path)
 	case "http", "https":
-		handler = newProxyHandler(hostname, hostPath, target)
+		var upstream UpstreamConfig
+		var failover failoverConfig
+		if upstream, err = hf.upstream.withOptions(opts); err != nil {
+			break
+		}
+		if failover, err = newFailoverConfig(opts); err != nil {
+			break
+		}
+		transport = hf.transports.get(upstream)
+		handler = newProxyHandler(hostname, hostPath, target, transport, failover)
 	case "redirect":
 		handler = newRedirectHandler(hostname, hostPath, target)
 	case "s3":
@@ -47,13 +82,62 @@ func (hf *HandlerFactory) Handler(hostname string, target url.URL) (handler http
 	default:
 		err = fmt.Errorf("unknown target URL scheme: %s", target.Scheme)
 	}
-	return
+	if err != nil {
+		return
+	}
+	if handler, err = applyOptions(handler, opts); err != nil {
+		return
+	}
+	th := &targetHandler{Handler: handler, limiter: limiter}
+	if health != nil {
+		if transport == nil {
+			return nil, fmt.Errorf("health checks are only supported for http and https targets")
+		}
+		th.health = newHealthChecker(route, target, health, transport)
+		if !dryRun {
+			go th.health.run()
+		}
+	}
+	return th, nil
 }
 
+// IsKnownScheme returns whether Handler supports the target URL scheme
+func (hf *HandlerFactory) IsKnownScheme(scheme string) bool {
+	switch scheme {
+	case "file", "http", "https", "redirect", "s3", "sftp", "php", "go-wasm", "tail", "tail-new":
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidateEntry builds the handler of a config entry in dry-run mode to see if it is valid
+func (hf *HandlerFactory) ValidateEntry(entry config.ConfigEntry) error {
+	if entry.IsTemplate() {
+		return hf.validateTemplate(entry)
+	}
+	_, err := hf.build(entry.Hostname, entry.Target, entry.Options, true)
+	return err
+}
+
+// validateTemplate builds the handler of a template entry without expanding its target
+func (hf *HandlerFactory) validateTemplate(entry config.ConfigEntry) error {
+	if entry.Options.Has("health.path") {
+		return fmt.Errorf("health checks are not supported for targets with captures")
+	}
+	_, err := hf.build(entry.Hostname, entry.Target, entry.Options, true)
+	return err
+}
+
+// splitHostnameAndPath splits a route to hostname and path. The path of regexp routes is not a prefix
+// of the request path, so it is left empty.
 func splitHostnameAndPath(hostname string) (string, string) {
 	i := strings.Index(hostname, "/")
 	if i == -1 {
 		return hostname, ""
 	}
+	if strings.HasPrefix(hostname[i:], "/~") {
+		return hostname[:i], ""
+	}
 	return hostname[:i], hostname[i:]
 }
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/config"
+)
+
+// healthCheckConfig contains the health.* route options
+type healthCheckConfig struct {
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	status   []statusRange
+	rise     int
+	fall     int
+}
+
+type statusRange struct {
+	min, max int
+}
+
+func newHealthCheckConfig(opts config.Options) (cfg *healthCheckConfig, err error) {
+	health := opts.Prefixed("health.")
+	if len(health) == 0 {
+		return nil, nil
+	}
+	for key := range health {
+		switch key {
+		case "path", "interval", "timeout", "status", "rise", "fall":
+		default:
+			return nil, fmt.Errorf("unknown health check option: health.%s", key)
+		}
+	}
+	cfg = &healthCheckConfig{path: health["path"]}
+	if !strings.HasPrefix(cfg.path, "/") {
+		return nil, fmt.Errorf("health.path has to be an absolute path")
+	}
+	if cfg.interval, err = opts.Duration("health.interval", 10*time.Second); err != nil {
+		return
+	}
+	if cfg.interval <= 0 {
+		return nil, fmt.Errorf("health.interval has to be positive")
+	}
+	if cfg.timeout, err = opts.Duration("health.timeout", 5*time.Second); err != nil {
+		return
+	}
+	if cfg.timeout <= 0 || cfg.timeout > cfg.interval {
+		cfg.timeout = cfg.interval
+	}
+	if cfg.status, err = parseStatusRanges(opts.Get("health.status", "200-399")); err != nil {
+		return
+	}
+	if cfg.rise, err = opts.Int("health.rise", 2); err != nil {
+		return
+	}
+	if cfg.fall, err = opts.Int("health.fall", 3); err != nil {
+		return
+	}
+	if cfg.rise < 1 || cfg.fall < 1 {
+		return nil, fmt.Errorf("health.rise and health.fall have to be at least 1")
+	}
+	return
+}
+
+// parseStatusRanges parses a list of status codes and ranges like 200,204 or 200-399
+func parseStatusRanges(text string) (ranges []statusRange, err error) {
+	for _, item := range strings.Split(text, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		var r statusRange
+		if r.min, err = strconv.Atoi(from); err != nil {
+			return nil, fmt.Errorf("bad health.status: %s", text)
+		}
+		r.max = r.min
+		if isRange {
+			if r.max, err = strconv.Atoi(to); err != nil || r.max < r.min {
+				return nil, fmt.Errorf("bad health.status: %s", text)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return
+}
+
+func (cfg *healthCheckConfig) isExpected(status int) bool {
+	for _, r := range cfg.status {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// healthChecker probes the backend periodically and reports whether it is healthy.
+// Backends start as healthy, then go down after fall failed probes in a row and come back after rise successful ones.
+type healthChecker struct {
+	cfg       *healthCheckConfig
+	name      string
+	url       string
+	client    *http.Client
+	healthy   atomic.Bool
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newHealthChecker(hostname string, target url.URL, cfg *healthCheckConfig, transport http.RoundTripper) *healthChecker {
+	probeURL := target
+	probeURL.Path = cfg.path
+	probeURL.RawQuery = ""
+	probeURL.Fragment = ""
+	h := &healthChecker{
+		cfg:  cfg,
+		name: hostname + " -> " + target.Redacted(),
+		url:  probeURL.String(),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		done: make(chan struct{}),
+	}
+	h.healthy.Store(true)
+	return h
+}
+
+func (h *healthChecker) Healthy() bool {
+	return h.healthy.Load()
+}
+
+// Close stops the health checks
+func (h *healthChecker) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+	return nil
+}
+
+func (h *healthChecker) run() {
+	ticker := time.NewTicker(h.cfg.interval)
+	defer ticker.Stop()
+	var successes, failures int
+	for {
+		if err := h.probe(); err != nil {
+			successes = 0
+			failures++
+			if failures == h.cfg.fall && h.healthy.Swap(false) {
+				log.Printf("HEALTH: %s [DOWN] %v", h.name, err)
+			}
+		} else {
+			failures = 0
+			successes++
+			if successes == h.cfg.rise && !h.healthy.Swap(true) {
+				log.Printf("HEALTH: %s [UP]", h.name)
+			}
+		}
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) probe() error {
+	resp, err := h.client.Get(h.url)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if !h.cfg.isExpected(resp.StatusCode) {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
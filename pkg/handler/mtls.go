@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/razzie/razvhost/pkg/config"
+)
+
+// Client certificate details forwarded to the backends of mtls routes
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+	clientCertHeader            = "X-Client-Cert"
+)
+
+// newMTLSHandler verifies the client certificate against the CA bundle of the route and forwards its details in headers.
+// The TLS handshake already requested the certificate, but it might have been verified by the CA bundle
+// of another route (e.g. a different SNI name than the Host header), so it is verified again.
+func newMTLSHandler(handler http.Handler, cfg *config.MTLSConfig) http.Handler {
+	roots := cfg.Pool()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(clientCertSubjectHeader)
+		r.Header.Del(clientCertFingerprintHeader)
+		r.Header.Del(clientCertHeader)
+
+		cert := verifiedClientCert(r, roots)
+		if cert == nil {
+			if cfg.Required {
+				http.Error(w, "Client certificate required", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if slices.Contains(cfg.Forward, "subject") {
+			r.Header.Set(clientCertSubjectHeader, cert.Subject.String())
+		}
+		if slices.Contains(cfg.Forward, "fingerprint") {
+			sum := sha256.Sum256(cert.Raw)
+			r.Header.Set(clientCertFingerprintHeader, hex.EncodeToString(sum[:]))
+		}
+		if slices.Contains(cfg.Forward, "pem") {
+			block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			r.Header.Set(clientCertHeader, url.QueryEscape(string(block)))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// verifiedClientCert returns the client certificate of the request if it is valid for client authentication
+// and issued by one of the roots
+func verifiedClientCert(r *http.Request, roots *x509.CertPool) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return nil
+	}
+	return cert
+}
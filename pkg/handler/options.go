@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/config"
+)
+
+// applyOptions wraps a handler with the generic per-route options
+func applyOptions(handler http.Handler, opts config.Options) (http.Handler, error) {
+	timeout, err := opts.Duration("timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		handler = newTimeoutHandler(handler, timeout)
+	}
+	if opts.Has("read-timeout") || opts.Has("write-timeout") {
+		handler, err = newDeadlineHandler(handler, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	maxHeaderBytes, err := opts.Int("max-header-bytes", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxHeaderBytes > 0 {
+		handler = newMaxHeaderBytesHandler(handler, maxHeaderBytes)
+	}
+	if opts.Has("auth") {
+		handler, err = newAuthHandler(handler, opts.Get("auth", ""))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if headers := opts.Prefixed("header."); len(headers) > 0 {
+		handler = newHeaderHandler(handler, headers)
+	}
+	mtls, err := config.NewMTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if mtls != nil {
+		handler = newMTLSHandler(handler, mtls)
+	}
+	return handler, nil
+}
+
+func newTimeoutHandler(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newDeadlineHandler overrides the read and write deadlines of the server for the route.
+// A zero timeout removes the deadline, which is useful for streams when the server has a write timeout.
+func newDeadlineHandler(handler http.Handler, opts config.Options) (http.Handler, error) {
+	readTimeout, err := opts.Duration("read-timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := opts.Duration("write-timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	setRead, setWrite := opts.Has("read-timeout"), opts.Has("write-timeout")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if setRead {
+			rc.SetReadDeadline(deadline(readTimeout))
+		}
+		if setWrite {
+			rc.SetWriteDeadline(deadline(writeTimeout))
+		}
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func newMaxHeaderBytesHandler(handler http.Handler, maxHeaderBytes int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+		for key, values := range r.Header {
+			for _, value := range values {
+				size += len(key) + len(value) + 4
+			}
+		}
+		if size > maxHeaderBytes {
+			http.Error(w, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func newAuthHandler(handler http.Handler, auth string) (http.Handler, error) {
+	method, credentials, _ := strings.Cut(auth, ":")
+	if method != "basic" {
+		return nil, fmt.Errorf("unknown auth method: %s", method)
+	}
+	user, pass, ok := strings.Cut(credentials, ":")
+	if !ok || len(user) == 0 {
+		return nil, fmt.Errorf("basic auth requires user:password")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqUser, reqPass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(reqPass), []byte(pass)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="razvhost", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del("Authorization")
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+func newHeaderHandler(handler http.Handler, headers map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for h, value := range headers {
+			w.Header().Set(h, value)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -1,12 +1,172 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/mux"
 )
 
-func newProxyHandler(hostname, hostPath string, target url.URL) http.Handler {
-	handler := httputil.NewSingleHostReverseProxy(&target)
+// UpstreamConfig contains the default timeouts of reverse proxy handlers.
+// Routes can override them with options of the same name.
+type UpstreamConfig struct {
+	DialTimeout           time.Duration // dial-timeout
+	TLSHandshakeTimeout   time.Duration // tls-handshake-timeout
+	ResponseHeaderTimeout time.Duration // response-header-timeout
+}
+
+// withOptions returns the config overridden by the route options
+func (c UpstreamConfig) withOptions(opts config.Options) (result UpstreamConfig, err error) {
+	if result.DialTimeout, err = opts.Duration("dial-timeout", c.DialTimeout); err != nil {
+		return
+	}
+	if result.TLSHandshakeTimeout, err = opts.Duration("tls-handshake-timeout", c.TLSHandshakeTimeout); err != nil {
+		return
+	}
+	result.ResponseHeaderTimeout, err = opts.Duration("response-header-timeout", c.ResponseHeaderTimeout)
+	return
+}
+
+// transportCache shares transports (and their connection pools) between routes with the same upstream config
+type transportCache struct {
+	mtx        sync.Mutex
+	transports map[UpstreamConfig]*http.Transport
+}
+
+func (c *transportCache) get(cfg UpstreamConfig) *http.Transport {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if t, ok := c.transports[cfg]; ok {
+		return t
+	}
+	if c.transports == nil {
+		c.transports = make(map[UpstreamConfig]*http.Transport)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	t.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	c.transports[cfg] = t
+	return t
+}
+
+// failoverConfig contains the passive health check options of a proxy target
+type failoverConfig struct {
+	cooldown time.Duration // failover.cooldown
+	retry    bool          // failover.retry
+}
+
+func newFailoverConfig(opts config.Options) (cfg failoverConfig, err error) {
+	if cfg.cooldown, err = opts.Duration("failover.cooldown", 10*time.Second); err != nil {
+		return
+	}
+	cfg.retry, err = opts.Bool("failover.retry", true)
+	return
+}
+
+// errRetry is returned by ModifyResponse to discard a failed response that is retried on another backend
+var errRetry = errors.New("retrying on another backend")
+
+func newProxyHandler(hostname, hostPath string, target url.URL, transport http.RoundTripper, failover failoverConfig) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(&target)
+	proxy.Transport = transport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusServiceUnavailable {
+			return nil
+		}
+		if failover.fail(resp.Request, true) {
+			log.Printf("proxy error: %s%s: upstream responded with %s (%v)", resp.Request.Host, resp.Request.URL.Path, resp.Status, errRetry)
+			return errRetry
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if err == errRetry {
+			return
+		}
+		status := proxyErrorStatus(r, err)
+		if status == http.StatusRequestTimeout || r.Context().Err() != nil {
+			// the client or the route timeout is to blame, not the backend
+			log.Printf("proxy error: %s%s: %v", r.Host, r.URL.Path, err)
+			w.WriteHeader(status)
+			return
+		}
+		if failover.fail(r, !isDialError(err)) {
+			log.Printf("proxy error: %s%s: %v (%v)", r.Host, r.URL.Path, err, errRetry)
+			return
+		}
+		log.Printf("proxy error: %s%s: %v", r.Host, r.URL.Path, err)
+		w.WriteHeader(status)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &requestBody{ReadCloser: r.Body}
+		}
+		proxy.ServeHTTP(w, r)
+	})
 	return handlePathCombinations(handler, hostname, hostPath, target.Path)
 }
+
+// requestBody remembers the last read error of the request body,
+// so a client that is too slow to send it can be told apart from an upstream error
+type requestBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *requestBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return
+}
+
+// fail ejects the backend of the request and returns whether the request is retried on another backend.
+// sent is false if the backend could not be reached, so even non-idempotent requests can be retried.
+func (cfg failoverConfig) fail(r *http.Request, sent bool) bool {
+	mux.Eject(r, cfg.cooldown)
+	return cfg.retry && mux.Retry(r, sent)
+}
+
+// proxyErrorStatus returns 408 if the client timed out sending the request,
+// 504 if the upstream timed out and 502 otherwise
+func proxyErrorStatus(r *http.Request, err error) int {
+	if body, ok := r.Body.(*requestBody); ok && isTimeout(body.err) {
+		return http.StatusRequestTimeout
+	}
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// isDialError tells whether the connection to the backend failed, so the request was not sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
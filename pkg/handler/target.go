@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/mux"
+)
+
+// TargetStats are the runtime statistics of a route target
+type TargetStats struct {
+	Healthy  bool   `json:"healthy"`
+	Active   int64  `json:"active"`
+	Queued   int64  `json:"queued"`
+	MaxConns int    `json:"max_conns,omitempty"`
+	MaxQueue int    `json:"max_queue,omitempty"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// targetHandler is the outermost handler of a route target. It applies the connection limit,
+// reports health to mux.Mux and collects statistics.
+type targetHandler struct {
+	http.Handler
+	health  *healthChecker
+	limiter *connLimiter
+	active  atomic.Int64
+}
+
+// Healthy implements mux.HealthChecker
+func (h *targetHandler) Healthy() bool {
+	return h.health == nil || h.health.Healthy()
+}
+
+// Close stops the health checks
+func (h *targetHandler) Close() error {
+	if h.health != nil {
+		return h.health.Close()
+	}
+	return nil
+}
+
+// Stats returns the current statistics of the target
+func (h *targetHandler) Stats() TargetStats {
+	stats := TargetStats{
+		Healthy: h.Healthy(),
+		Active:  h.active.Load(),
+	}
+	if h.limiter != nil {
+		stats.Queued = h.limiter.queued.Load()
+		stats.MaxConns = cap(h.limiter.slots)
+		stats.MaxQueue = int(h.limiter.maxQueue)
+		stats.Rejected = h.limiter.rejected.Load()
+	}
+	return stats
+}
+
+func (h *targetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.limiter != nil {
+		if !h.limiter.acquire(r.Context()) {
+			h.limiter.reject(w, r)
+			return
+		}
+		defer h.limiter.release()
+	}
+	h.active.Add(1)
+	defer h.active.Add(-1)
+	h.Handler.ServeHTTP(w, r)
+}
+
+// StatsOf returns the statistics of a handler returned by HandlerFactory
+func StatsOf(handler http.Handler) (TargetStats, bool) {
+	if h, ok := handler.(*targetHandler); ok {
+		return h.Stats(), true
+	}
+	return TargetStats{}, false
+}
+
+// connLimiter limits the concurrent requests of a target. Requests over the limit wait in a bounded queue.
+type connLimiter struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+	queued   atomic.Int64
+	rejected atomic.Uint64
+}
+
+// newConnLimiter returns a limiter from the max-conns, queue and queue-timeout options,
+// or nil if max-conns is not set
+func newConnLimiter(opts config.Options) (*connLimiter, error) {
+	maxConns, err := opts.Int("max-conns", 0)
+	if err != nil || maxConns <= 0 {
+		return nil, err
+	}
+	maxQueue, err := opts.Int("queue", 100)
+	if err != nil {
+		return nil, err
+	}
+	if maxQueue < 0 {
+		return nil, fmt.Errorf("queue cannot be negative")
+	}
+	timeout, err := opts.Duration("queue-timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &connLimiter{
+		slots:    make(chan struct{}, maxConns),
+		maxQueue: int64(maxQueue),
+		timeout:  timeout,
+	}, nil
+}
+
+func (l *connLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *connLimiter) release() {
+	<-l.slots
+}
+
+// reject retries the request on another backend if possible (it was not sent to this one), or responds with 503
+func (l *connLimiter) reject(w http.ResponseWriter, r *http.Request) {
+	if mux.Retry(r, false) {
+		return
+	}
+	l.rejected.Add(1)
+	retryAfter := int(math.Max(1, math.Ceil(l.timeout.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+}
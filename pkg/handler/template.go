@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/mux"
+)
+
+// maxTemplateHandlers is the number of expanded targets a template route keeps handlers for
+const maxTemplateHandlers = 1000
+
+// templateHandler serves a regexp route whose target refers to captures. A handler is built for each
+// expanded target on first use, and the least recently built ones are closed when there are too many.
+type templateHandler struct {
+	factory  *HandlerFactory
+	route    string
+	target   url.URL
+	opts     config.Options
+	mtx      sync.Mutex
+	handlers map[string]http.Handler
+	order    []string
+}
+
+func newTemplateHandler(factory *HandlerFactory, route string, target url.URL, opts config.Options) *templateHandler {
+	return &templateHandler{
+		factory:  factory,
+		route:    route,
+		target:   target,
+		opts:     opts,
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+func (h *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, err := config.ExpandTarget(h.target, mux.Captures(r))
+	if err != nil {
+		log.Printf("template error: %s%s: %v", r.Host, r.URL.Path, err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	handler, err := h.handler(target)
+	if err != nil {
+		log.Printf("template error: %s%s: %v", r.Host, r.URL.Path, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+func (h *templateHandler) handler(target url.URL) (http.Handler, error) {
+	key := target.String()
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if handler, ok := h.handlers[key]; ok {
+		return handler, nil
+	}
+	handler, err := h.factory.build(h.route, target, h.opts, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.order) >= maxTemplateHandlers {
+		closeHandler(h.handlers[h.order[0]])
+		delete(h.handlers, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.handlers[key] = handler
+	h.order = append(h.order, key)
+	return handler, nil
+}
+
+// Close closes the handlers of the expanded targets
+func (h *templateHandler) Close() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for _, handler := range h.handlers {
+		closeHandler(handler)
+	}
+	h.handlers = make(map[string]http.Handler)
+	h.order = nil
+	return nil
+}
+
+func closeHandler(handler http.Handler) {
+	if closer, ok := handler.(io.Closer); ok {
+		closer.Close()
+	}
+}
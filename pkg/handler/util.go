@@ -4,11 +4,17 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/razzie/razvhost/pkg/mux"
 	"github.com/razzie/razvhost/pkg/stream"
 )
 
 func handlePathCombinations(handler http.Handler, hostname, hostPath, targetPath string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostPath := hostPath
+		if matched, ok := mux.Captures(r)["0"]; ok && strings.HasPrefix(r.URL.Path, matched) {
+			// regexp paths are handled like prefixes if they match the start of the path
+			hostPath = matched
+		}
 		r.URL.Path = strings.TrimPrefix(r.URL.Path, hostPath)
 		r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, hostPath)
 		if !strings.HasPrefix(r.URL.Path, "/") {
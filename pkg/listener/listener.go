@@ -0,0 +1,70 @@
+package listener
+
+import (
+	"net"
+	"sync"
+)
+
+var (
+	mtx       sync.Mutex
+	inherited map[string]net.Listener
+	active    = make(map[string]net.Listener)
+)
+
+// Listen returns a TCP listener for addr. Listeners inherited from systemd socket activation
+// or from the previous process during an upgrade are used first, matched by name or address.
+func Listen(name, addr string) (net.Listener, error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if inherited == nil {
+		inherited = inheritListeners()
+	}
+
+	ln := takeInherited(name, addr)
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	active[name] = ln
+	return ln, nil
+}
+
+// Release removes a closed listener from the ones passed to new processes on upgrade
+func Release(name string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	delete(active, name)
+}
+
+func takeInherited(name, addr string) net.Listener {
+	if ln, ok := inherited[name]; ok {
+		delete(inherited, name)
+		return ln
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	for lnName, ln := range inherited {
+		if matchAddr(tcpAddr, ln.Addr()) {
+			delete(inherited, lnName)
+			return ln
+		}
+	}
+	return nil
+}
+
+func matchAddr(addr *net.TCPAddr, other net.Addr) bool {
+	otherAddr, ok := other.(*net.TCPAddr)
+	if !ok || addr.Port != otherAddr.Port {
+		return false
+	}
+	if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
+		return len(otherAddr.IP) == 0 || otherAddr.IP.IsUnspecified()
+	}
+	return addr.IP.Equal(otherAddr.IP)
+}
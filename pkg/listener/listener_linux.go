@@ -0,0 +1,122 @@
+package listener
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	listenFdsStart = 3
+
+	envListenFds     = "RAZVHOST_LISTEN_FDS"
+	envListenFdNames = "RAZVHOST_LISTEN_FDNAMES"
+	envParentPid     = "RAZVHOST_PARENT_PID"
+)
+
+// Upgrade starts the current executable again with the same arguments and passes the active listeners to it.
+// The new process asks this one to shut down gracefully by sending SIGTERM once it is ready.
+func Upgrade() (*os.Process, error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	var names []string
+	for name, ln := range active {
+		tcpLn, ok := ln.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		file, err := tcpLn.File()
+		if err != nil {
+			closeFiles(files[listenFdsStart:])
+			return nil, fmt.Errorf("cannot pass listener %s: %v", name, err)
+		}
+		files = append(files, file)
+		names = append(names, name)
+	}
+	defer closeFiles(files[listenFdsStart:])
+
+	env := []string{
+		envListenFds + "=" + strconv.Itoa(len(names)),
+		envListenFdNames + "=" + strings.Join(names, ":"),
+		envParentPid + "=" + strconv.Itoa(os.Getpid()),
+	}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "RAZVHOST_") && !strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+
+	return os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+}
+
+// Ready tells the parent process of an upgrade to shut down
+func Ready() {
+	ppid, err := strconv.Atoi(os.Getenv(envParentPid))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(envParentPid)
+	if err := syscall.Kill(ppid, syscall.SIGTERM); err != nil {
+		log.Println("Failed to notify parent process:", err)
+	}
+}
+
+// inheritListeners returns the listeners passed by systemd socket activation or by the parent process
+func inheritListeners() map[string]net.Listener {
+	listeners := make(map[string]net.Listener)
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		inheritFds(listeners, "LISTEN_FDS", "LISTEN_FDNAMES")
+		os.Unsetenv("LISTEN_PID")
+	} else {
+		inheritFds(listeners, envListenFds, envListenFdNames)
+	}
+	return listeners
+}
+
+func inheritFds(listeners map[string]net.Listener, fdsEnv, namesEnv string) {
+	count, _ := strconv.Atoi(os.Getenv(fdsEnv))
+	names := strings.Split(os.Getenv(namesEnv), ":")
+	os.Unsetenv(fdsEnv)
+	os.Unsetenv(namesEnv)
+
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "fd" + strconv.Itoa(fd)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			log.Printf("Cannot use inherited listener %s: %v", name, err)
+			continue
+		}
+		if _, exists := listeners[name]; exists {
+			name = "fd" + strconv.Itoa(fd)
+		}
+		log.Printf("Inherited listener %s on %s", name, ln.Addr())
+		listeners[name] = ln
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
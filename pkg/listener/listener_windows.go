@@ -0,0 +1,20 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Upgrade is not supported on Windows
+func Upgrade() (*os.Process, error) {
+	return nil, fmt.Errorf("upgrade is not supported on windows")
+}
+
+// Ready is a no-op on Windows
+func Ready() {
+}
+
+func inheritListeners() map[string]net.Listener {
+	return make(map[string]net.Listener)
+}
@@ -0,0 +1,211 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// balancer serves a request with one of the handlers of an entry.
+// If the handler reports a failure with Retry, the request is served again by another handler.
+type balancer struct {
+	handlers []*muxHandler
+	strategy Strategy
+	sticky   string
+	captures map[string]string // submatches of regexp entries
+}
+
+type attemptKey struct{}
+
+// attempt is passed to handlers in the request context, so they can report failures
+type attempt struct {
+	balancer *balancer
+	handler  *muxHandler
+	tried    []*muxHandler
+	body     *retryBody
+	retrying bool
+}
+
+// maxRetryBody is the number of request body bytes buffered for retries.
+// Requests that sent more of their body to a failed handler are not retried.
+const maxRetryBody = 64 << 10
+
+// retryBody buffers the request body read by the attempts, so it can be replayed by the next one
+type retryBody struct {
+	mtx      sync.Mutex
+	body     io.ReadCloser
+	buf      []byte
+	overflow bool // more than maxRetryBody bytes were read, buf is dropped
+}
+
+// replayable tells whether every byte read from the body is buffered
+func (b *retryBody) replayable() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return !b.overflow
+}
+
+// attemptBody is the request body of an attempt: the buffered bytes, then the rest of the original body.
+// It is detached when the next attempt starts, because the transport of a failed attempt may still be reading it.
+type attemptBody struct {
+	*retryBody
+	off      int
+	detached bool
+}
+
+var errBodyDetached = errors.New("request body is replayed to another backend")
+
+func (b *attemptBody) Read(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.detached {
+		return 0, errBodyDetached
+	}
+	if b.off < len(b.buf) {
+		n := copy(p, b.buf[b.off:])
+		b.off += n
+		return n, nil
+	}
+	n, err := b.body.Read(p)
+	b.off += n
+	switch {
+	case b.overflow:
+	case b.off > maxRetryBody:
+		b.buf, b.overflow = nil, true
+	default:
+		b.buf = append(b.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// Close keeps the original body open for the next attempt, the server closes it after the request
+func (b *attemptBody) Close() error {
+	return nil
+}
+
+func (b *attemptBody) detach() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.detached = true
+}
+
+func (b *balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var tried []*muxHandler
+	var body *retryBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &retryBody{body: r.Body}
+	}
+	for {
+		h := b.pick(r, tried)
+		if h == nil {
+			unavailableHandler.ServeHTTP(w, r)
+			return
+		}
+		tried = append(tried, h)
+		if len(b.sticky) > 0 {
+			b.setStickyCookie(w, r, h)
+		}
+		a := &attempt{balancer: b, handler: h, tried: tried, body: body}
+		req := r.Clone(context.WithValue(r.Context(), attemptKey{}, a))
+		var reqBody *attemptBody
+		if body != nil {
+			reqBody = &attemptBody{retryBody: body}
+			req.Body = reqBody
+		}
+		h.serveHTTP(w, req)
+		if !a.retrying {
+			return
+		}
+		if reqBody != nil {
+			reqBody.detach()
+		}
+	}
+}
+
+// pick selects a healthy handler that is not in skip.
+// The handler pinned by the sticky session cookie comes first, then the strategy of the entry decides.
+func (b *balancer) pick(r *http.Request, skip []*muxHandler) *muxHandler {
+	candidates := b.candidates(skip)
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(b.sticky) > 0 {
+		if h := b.stickyHandler(r, candidates); h != nil {
+			return h
+		}
+	}
+	return b.strategy.Pick(r, candidates)
+}
+
+// candidates returns the healthy handlers not in skip, in order of preference:
+// primary handlers, then backups, then handlers ejected by passive health checks
+func (b *balancer) candidates(skip []*muxHandler) []*muxHandler {
+	var primaries, backups, ejected, ejectedBackups []*muxHandler
+	for _, h := range b.handlers {
+		if contains(skip, h) || !h.healthy() {
+			continue
+		}
+		switch {
+		case h.ejected() && h.backup:
+			ejectedBackups = append(ejectedBackups, h)
+		case h.ejected():
+			ejected = append(ejected, h)
+		case h.backup:
+			backups = append(backups, h)
+		default:
+			primaries = append(primaries, h)
+		}
+	}
+	for _, candidates := range [][]*muxHandler{primaries, backups, ejected} {
+		if len(candidates) > 0 {
+			return candidates
+		}
+	}
+	return ejectedBackups
+}
+
+// Captures returns the submatches of the regexp hostname and path of the entry serving r by name and by index.
+// The match of the path regexp is 0.
+func Captures(r *http.Request) map[string]string {
+	if a, ok := r.Context().Value(attemptKey{}).(*attempt); ok {
+		return a.balancer.captures
+	}
+	return nil
+}
+
+// Eject excludes the handler serving r from load balancing for the cooldown period,
+// unless there is no other handler to choose
+func Eject(r *http.Request, cooldown time.Duration) {
+	if a, ok := r.Context().Value(attemptKey{}).(*attempt); ok && cooldown > 0 {
+		a.handler.eject(cooldown)
+	}
+}
+
+// Retry marks r to be served again by another handler of the same entry.
+// If sent is true, the failed handler may have processed the request, so it is only retried if it is idempotent.
+// The body read by the failed handler is replayed from a buffer, so the request is not retried
+// if more than maxRetryBody bytes of it were read. There also has to be another healthy handler.
+// If Retry returns true, the handler must return without writing a response.
+func Retry(r *http.Request, sent bool) bool {
+	a, ok := r.Context().Value(attemptKey{}).(*attempt)
+	if !ok || (sent && !isIdempotent(r.Method)) || (a.body != nil && !a.body.replayable()) {
+		return false
+	}
+	if len(a.balancer.candidates(a.tried)) == 0 {
+		return false
+	}
+	a.retrying = true
+	return true
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,120 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errTestRetry = errors.New("retrying")
+
+// testProxy reports failures of the backend at target like the reverse proxy handler does
+func testProxy(t *testing.T, target string) http.Handler {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			Eject(resp.Request, time.Minute)
+			if Retry(resp.Request, true) {
+				return errTestRetry
+			}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if err == errTestRetry {
+			return
+		}
+		var opErr *net.OpError
+		Eject(r, time.Minute)
+		if Retry(r, !(errors.As(err, &opErr) && opErr.Op == "dial")) {
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// testBackend counts its requests and responds with status and the request body
+func testBackend(t *testing.T, status int, requests *atomic.Int32) string {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(backend.Close)
+	return backend.URL
+}
+
+func TestFailover(t *testing.T) {
+	var healthyRequests, failingRequests atomic.Int32
+	healthy := testBackend(t, http.StatusOK, &healthyRequests)
+	failing := testBackend(t, http.StatusServiceUnavailable, &failingRequests)
+	refused := httptest.NewServer(nil)
+	refused.Close()
+
+	large := strings.Repeat("x", maxRetryBody+1)
+	tests := []struct {
+		name     string
+		backends []string // the first one is tried first
+		method   string
+		body     string
+		status   int
+		healthy  int32 // requests to the healthy backend
+	}{
+		{"get", []string{failing, healthy}, "GET", "", http.StatusOK, 1},
+		{"put body replayed", []string{failing, healthy}, "PUT", "payload", http.StatusOK, 1},
+		{"large put body replayed", []string{failing, healthy}, "PUT", large[1:], http.StatusOK, 1},
+		{"post after refused connection", []string{refused.URL, healthy}, "POST", "payload", http.StatusOK, 1},
+		{"post not retried", []string{failing, healthy}, "POST", "payload", http.StatusServiceUnavailable, 0},
+		{"oversized body not retried", []string{failing, healthy}, "PUT", large, http.StatusServiceUnavailable, 0},
+		{"no other backend", []string{failing}, "GET", "", http.StatusServiceUnavailable, 0},
+		{"every backend refused", []string{refused.URL, refused.URL + "/"}, "GET", "", http.StatusBadGateway, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthyRequests.Store(0)
+			failingRequests.Store(0)
+			var m Mux
+			for _, backend := range tt.backends {
+				m.Add("example.com", testProxy(t, backend), backend)
+			}
+			serve := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(tt.method, "http://example.com/", strings.NewReader(tt.body))
+				m.Handler(r).ServeHTTP(w, r)
+				return w
+			}
+
+			w := serve()
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if healthyRequests.Load() != tt.healthy {
+				t.Errorf("healthy backend got %d requests, want %d", healthyRequests.Load(), tt.healthy)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != tt.body {
+				t.Errorf("healthy backend got a body of %d bytes, want %d", w.Body.Len(), len(tt.body))
+			}
+
+			// the failed backend is ejected, unless it is the only one
+			failed := failingRequests.Load()
+			serve()
+			if len(tt.backends) > 1 && failingRequests.Load() != failed {
+				t.Error("failed backend was not ejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package mux
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Matcher is a set of conditions a request has to meet to be served by a backend.
+// Each condition lists the accepted values, and all conditions have to be met.
+type Matcher struct {
+	Methods []string
+	Headers map[string][]string // an empty list only requires the header to be present
+	Query   map[string][]string // an empty list only requires the parameter to be present
+	Nets    []netip.Prefix      // client IP ranges
+}
+
+// Match tells whether r meets the conditions
+func (m *Matcher) Match(r *http.Request) bool {
+	if len(m.Methods) > 0 && !containsFold(m.Methods, r.Method) {
+		return false
+	}
+	for name, values := range m.Headers {
+		if !matchHeader(r.Header.Values(name), values) {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := r.URL.Query()
+		for name, values := range m.Query {
+			actual, ok := query[name]
+			if !ok || (len(values) > 0 && !containsAny(values, actual)) {
+				return false
+			}
+		}
+	}
+	if len(m.Nets) > 0 {
+		addr, err := netip.ParseAddr(clientIP(r))
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, prefix := range m.Nets {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchHeader tells whether a header value or an element of a comma separated header value is accepted,
+// so Connection: keep-alive, Upgrade matches upgrade
+func matchHeader(actual, accepted []string) bool {
+	if len(actual) == 0 {
+		return false
+	}
+	if len(accepted) == 0 {
+		return true
+	}
+	for _, value := range actual {
+		if containsFold(accepted, strings.TrimSpace(value)) {
+			return true
+		}
+		for _, item := range strings.Split(value, ",") {
+			if containsFold(accepted, strings.TrimSpace(item)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values, actual []string) bool {
+	for _, value := range actual {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,20 +2,68 @@ package mux
 
 import (
 	"net/http"
-	"path/filepath"
-	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
-// Mux is a http.Handler router similar to http.ServeMux, but with load balancing
+// HealthChecker is implemented by handlers that know whether their backend is healthy.
+// Unhealthy handlers are skipped by Mux.
+type HealthChecker interface {
+	Healthy() bool
+}
+
+// Mux is a http.Handler router similar to http.ServeMux, but with load balancing.
+// See router for the precedence of entries.
 type Mux struct {
 	mtx      sync.RWMutex
-	entries  []*muxEntry
 	entryMap map[string]*muxEntry
+	router   router
+}
+
+// Backend is a handler with its load balancing settings
+type Backend struct {
+	Handler  http.Handler
+	ID       string
+	Weight   int    // relative weight, defaults to 1
+	Strategy string // strategy of the entry, see NewStrategy. The first backend that sets it wins.
+	HashKey  string
+	Sticky   string // cookie name of sticky sessions of the entry. The first backend that sets it wins.
+	Backup   bool   // only used if no primary backend is healthy
+	Match    *Matcher
+	State    *BackendState // shared by every entry the backend is added to, see BackendState
+}
+
+// BackendState is the runtime state of a backend that outlives the Mux it is added to.
+// Routing tables are rebuilt on config changes, so passing the same state to the new Mux
+// keeps the backend ejected, its outstanding requests counted and the round-robin sequence going.
+// AddBackend creates a new state if the backend has none.
+type BackendState struct {
+	inflight      atomic.Int64
+	ejectedUntil  atomic.Int64
+	currentWeight atomic.Int64 // used by roundRobin, atomic because the state is shared by the entries of several muxes
 }
 
 func (m *Mux) Add(path string, handler http.Handler, id string) {
+	m.AddBackend(path, Backend{Handler: handler, ID: id})
+}
+
+// AddBackend adds a handler with load balancing settings to the entry of path
+func (m *Mux) AddBackend(path string, b Backend) error {
+	var strategy Strategy
+	if len(b.Strategy) > 0 || len(b.HashKey) > 0 {
+		var err error
+		if strategy, err = NewStrategy(b.Strategy, b.HashKey); err != nil {
+			return err
+		}
+	}
+	if b.Weight < 1 {
+		b.Weight = 1
+	}
+	if b.State == nil {
+		b.State = new(BackendState)
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -25,30 +73,20 @@ func (m *Mux) Add(path string, handler http.Handler, id string) {
 
 	entry := m.entryMap[path]
 	if entry != nil {
-		entry.add(handler, id)
-		return
+		entry.add(b, strategy)
+		return nil
 	}
 
 	entry = &muxEntry{
 		path:     path,
-		wildcard: strings.ContainsAny(path, "*?[]"),
-		parts:    strings.Split(path, "/"),
+		strategy: &roundRobin{},
 	}
-	entry.add(handler, id)
-	m.entryMap[path] = entry
-
-	for i, other := range m.entries {
-		if entry.wildcard && !other.wildcard {
-			continue
-		}
-		if len(path) > len(other.path) {
-			m.entries = append(m.entries[:i+1], m.entries[i:]...)
-			m.entries[i] = entry
-			return
-		}
+	if err := m.router.add(entry); err != nil {
+		return err
 	}
-
-	m.entries = append(m.entries, entry)
+	entry.add(b, strategy)
+	m.entryMap[path] = entry
+	return nil
 }
 
 func (m *Mux) Remove(path, id string) {
@@ -60,106 +98,186 @@ func (m *Mux) Remove(path, id string) {
 		entry.remove(id)
 		if len(entry.handlers) == 0 {
 			delete(m.entryMap, path)
+			m.router.remove(entry)
 		}
 	}
 }
 
+// Contains tells whether there is an entry matching path
 func (m *Mux) Contains(path string) bool {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
-	for _, entry := range m.entries {
-		if entry.match(path) {
-			return false
-		}
-	}
-
-	return false
+	entry, _ := m.router.match(path, nil)
+	return entry != nil
 }
 
-func (m *Mux) ContainsHost(path string) bool {
+// ContainsHost tells whether there is an entry for the hostname
+func (m *Mux) ContainsHost(host string) bool {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
-	for _, entry := range m.entries {
-		if entry.matchHost(path) {
-			return false
-		}
-	}
+	_, ok := m.router.matchHost(host)
+	return ok
+}
 
-	return false
+// HostPattern returns the hostname of the entries that serve host, which is either host itself
+// or a pattern like *.example.com
+func (m *Mux) HostPattern(host string) (string, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.router.matchHost(host)
 }
 
-func (m *Mux) Handler(path string) http.Handler {
+// ShadowedBy returns the path of an entry that takes precedence over the given entry for its own path,
+// which makes the entry unreachable. Regexp entries are not checked.
+// Since entries are ordered by specificity instead of the order they were added, a more general entry never
+// shadows a more specific one, so this only happens when a /~regex path of the same hostname matches the path.
+func (m *Mux) ShadowedBy(path string) (string, bool) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
-	for _, entry := range m.entries {
-		if entry.match(path) {
-			if handler := entry.handler(); handler != nil {
-				return handler
-			}
-		}
+	if host, p := SplitRoute(path); isRegexp(host) || (len(p) > 0 && isRegexp(p[1:])) {
+		return "", false
 	}
+	if entry, _ := m.router.match(path, nil); entry != nil && entry.path != path {
+		return entry.path, true
+	}
+	return "", false
+}
+
+// Handler returns the handler of the entry matching the hostname and path of r.
+// Entries without a backend whose match conditions are met by r are skipped.
+func (m *Mux) Handler(r *http.Request) http.Handler {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 
+	var handlers []*muxHandler
+	accept := func(entry *muxEntry) bool {
+		handlers = entry.handlersFor(r)
+		return len(handlers) > 0
+	}
+	if entry, captures := m.router.match(r.Host+r.URL.Path, accept); entry != nil {
+		return &balancer{handlers: handlers, strategy: entry.strategy, sticky: entry.sticky, captures: captures}
+	}
 	return nil
 }
 
 type muxEntry struct {
 	path     string
-	handlers []muxHandler
-	next     uint32
-	wildcard bool
-	parts    []string
+	handlers []*muxHandler // replaced on change, because balancers keep using the previous slice
+	strategy Strategy
+	custom   bool // strategy is set by a backend
+	sticky   string
+	matchers int // number of handlers with match conditions
 }
 
-func (e *muxEntry) match(path string) bool {
-	if !e.wildcard {
-		if len(path) < len(e.path) {
-			return false
+// handlersFor returns the handlers whose match conditions are met by r,
+// or if there are none, the handlers without match conditions
+func (e *muxEntry) handlersFor(r *http.Request) []*muxHandler {
+	if e.matchers == 0 {
+		return e.handlers
+	}
+	var matched, fallback []*muxHandler
+	for _, h := range e.handlers {
+		switch {
+		case h.match == nil:
+			fallback = append(fallback, h)
+		case h.match.Match(r):
+			matched = append(matched, h)
 		}
-		return strings.HasPrefix(path, e.path)
 	}
-	parts := strings.Split(path, "/")
-	if len(parts) < len(e.parts) {
-		return false
+	if len(matched) > 0 {
+		return matched
 	}
-	parts = parts[:len(e.parts)]
-	match, _ := filepath.Match(e.path, strings.Join(parts, "/"))
-	return match
+	return fallback
 }
 
-func (e *muxEntry) matchHost(host string) bool {
-	if !e.wildcard {
-		return e.parts[0] == host
+func (e *muxEntry) add(b Backend, strategy Strategy) {
+	if strategy != nil && !e.custom {
+		e.strategy = strategy
+		e.custom = true
+	}
+	if len(e.sticky) == 0 {
+		e.sticky = b.Sticky
+	}
+	handlers := make([]*muxHandler, len(e.handlers), len(e.handlers)+1)
+	copy(handlers, e.handlers)
+	e.handlers = append(handlers, &muxHandler{
+		handler: b.Handler,
+		id:      b.ID,
+		token:   stickyToken(b.ID),
+		weight:  b.Weight,
+		backup:  b.Backup,
+		match:   b.Match,
+		state:   b.State,
+	})
+	if b.Match != nil {
+		e.matchers++
 	}
-	match, _ := filepath.Match(e.parts[0], host)
-	return match
-}
-
-func (e *muxEntry) add(handler http.Handler, id string) {
-	e.handlers = append(e.handlers, muxHandler{handler: handler, id: id})
 }
 
 func (e *muxEntry) remove(id string) {
 	for i, handler := range e.handlers {
 		if handler.id == id {
-			e.handlers = append(e.handlers[:i], e.handlers[i+1:]...)
+			if handler.match != nil {
+				e.matchers--
+			}
+			handlers := make([]*muxHandler, 0, len(e.handlers)-1)
+			handlers = append(handlers, e.handlers[:i]...)
+			e.handlers = append(handlers, e.handlers[i+1:]...)
 			return
 		}
 	}
 }
 
-func (e *muxEntry) handler() http.Handler {
-	handlersCount := uint32(len(e.handlers))
-	if handlersCount == 0 {
-		return nil
-	}
-	next := int(atomic.AddUint32(&e.next, 1) % handlersCount)
-	return e.handlers[next].handler
-}
-
 type muxHandler struct {
 	handler http.Handler
 	id      string
+	token   string // identifies the handler in sticky session cookies
+	weight  int
+	backup  bool
+	match   *Matcher
+	state   *BackendState
 }
+
+func (h *muxHandler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	h.state.inflight.Add(1)
+	defer h.state.inflight.Add(-1)
+	h.handler.ServeHTTP(w, r)
+}
+
+// load returns the outstanding requests relative to weight
+func (h *muxHandler) load() float64 {
+	return float64(h.state.inflight.Load()) / float64(h.weight)
+}
+
+// healthy returns the state reported by active health checks
+func (h *muxHandler) healthy() bool {
+	if checker, ok := h.handler.(HealthChecker); ok {
+		return checker.Healthy()
+	}
+	return true
+}
+
+func (h *muxHandler) ejected() bool {
+	return time.Now().UnixNano() < h.state.ejectedUntil.Load()
+}
+
+func (h *muxHandler) eject(cooldown time.Duration) {
+	h.state.ejectedUntil.Store(time.Now().Add(cooldown).UnixNano())
+}
+
+func contains(handlers []*muxHandler, handler *muxHandler) bool {
+	for _, h := range handlers {
+		if h == handler {
+			return true
+		}
+	}
+	return false
+}
+
+var unavailableHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "No healthy backend", http.StatusServiceUnavailable)
+})
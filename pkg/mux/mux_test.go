@@ -0,0 +1,77 @@
+package mux
+
+import "testing"
+
+func TestHostMatching(t *testing.T) {
+	var m Mux
+	for _, path := range []string{
+		"example.com",
+		"api.example.com/v1",
+		"example.com:8080",
+		"*.example.com",
+		"*.eu.example.com",
+		"~^(a|b)\\.example\\.net$",
+		"web-??.example.org",
+	} {
+		m.Add(path, nil, "")
+	}
+	tests := []struct {
+		host    string
+		pattern string // empty if no entry serves the host
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.COM", "example.com"},
+		{"example.com:443", "example.com"},
+		{"example.com:8080", "example.com:8080"},
+		{"api.example.com", "api.example.com"},
+		{"www.example.com", "*.example.com"},
+		{"www.example.com:8443", "*.example.com"},
+		{"a.b.example.com", "*.example.com"},
+		{"www.eu.example.com", "*.eu.example.com"},
+		{"eu.example.com", "*.example.com"},
+		{"example.org", ""},
+		{"a.example.net", "~^(a|b)\\.example\\.net$"},
+		{"a.example.net:80", "~^(a|b)\\.example\\.net$"},
+		{"c.example.net", ""},
+		{"web-01.example.org", "web-??.example.org"},
+		{"web-1.example.org", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		pattern, ok := m.HostPattern(tt.host)
+		if pattern != tt.pattern || ok != (len(tt.pattern) > 0) {
+			t.Errorf("HostPattern(%q) = %q, %v, want %q", tt.host, pattern, ok, tt.pattern)
+		}
+		if contains := m.ContainsHost(tt.host); contains != (len(tt.pattern) > 0) {
+			t.Errorf("ContainsHost(%q) = %v", tt.host, contains)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	var m Mux
+	for _, path := range []string{"example.com/app", "*.example.com/static/", "~^(a|b)\\.example\\.net$/api", "shop.example.org:8443"} {
+		m.Add(path, nil, "")
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"example.com/app", true},
+		{"example.com/app/index.html", true},
+		{"example.com:443/app", true},
+		{"example.com/", false},
+		{"example.com/application", false},
+		{"cdn.example.com/static/app.js", true},
+		{"cdn.example.com/static", false},
+		{"a.example.net/api/users", true},
+		{"c.example.net/api", false},
+		{"shop.example.org:8443/cart", true},
+		{"shop.example.org/cart", false},
+	}
+	for _, tt := range tests {
+		if got := m.Contains(tt.path); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
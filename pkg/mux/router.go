@@ -0,0 +1,465 @@
+package mux
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// router finds the entry of a request in time proportional to the length of the request path
+// instead of the number of entries. Hostnames are looked up in this order:
+//   - exact hostnames (with port first, then without)
+//   - *.domain wildcards, the longest suffix first
+//   - ~regex hostnames, in the order they were added
+//   - other glob patterns like ex?mple.com, the longest pattern first (so * is the last)
+//
+// The first hostname that has an entry matching the path wins. Within a hostname /~regex paths
+// are tried first in the order they were added, then the entry with the most path segments wins,
+// and static segments take precedence over glob segments.
+type router struct {
+	hosts    map[string]*pathNode
+	suffixes hostNode
+	regexps  []*hostRegexp
+	patterns []*hostPattern
+}
+
+// hostNode is a node of the suffix tree of *.domain wildcards, keyed by labels from right to left
+type hostNode struct {
+	children map[string]*hostNode
+	pattern  string
+	routes   *pathNode
+}
+
+type hostPattern struct {
+	pattern string
+	routes  *pathNode
+}
+
+type hostRegexp struct {
+	pattern string
+	re      *regexp.Regexp
+	routes  *pathNode
+}
+
+// pathNode is a node of the path trie of a hostname, keyed by path segments
+type pathNode struct {
+	segment  string // glob pattern of the segment if the node is in patterns of its parent
+	entry    *muxEntry
+	dirEntry *muxEntry // entry with a trailing slash, only matches if the request path continues
+	static   map[string]*pathNode
+	patterns []*pathNode
+	regexps  []*pathRegexp // only in the root node
+}
+
+type pathRegexp struct {
+	re    *regexp.Regexp
+	entry *muxEntry
+}
+
+// IsPattern tells whether a hostname or path segment of an entry is a pattern instead of a literal name
+func IsPattern(s string) bool {
+	return isRegexp(s) || strings.ContainsAny(s, "*?[")
+}
+
+// isRegexp tells whether a hostname or path (without the leading slash) of an entry is a regular expression
+func isRegexp(s string) bool {
+	return strings.HasPrefix(s, "~")
+}
+
+// isSuffixWildcard tells whether host is like *.domain, which are stored in the suffix tree
+func isSuffixWildcard(host string) bool {
+	return strings.HasPrefix(host, "*.") && !IsPattern(host[2:])
+}
+
+// SplitRoute splits an entry path or request path to hostname and path.
+// Hostnames are case-insensitive, so they are lowercased unless they are regular expressions.
+func SplitRoute(route string) (host, path string) {
+	host, path = route, ""
+	if i := strings.IndexByte(route, '/'); i >= 0 {
+		host, path = route[:i], route[i:]
+	}
+	if !isRegexp(host) {
+		host = strings.ToLower(host)
+	}
+	return
+}
+
+func stripPort(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+		return host[:i]
+	}
+	return host
+}
+
+// cutSegment returns the first segment of a path starting with a slash and the rest of the path
+func cutSegment(path string) (segment, rest string) {
+	path = path[1:]
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i], path[i:]
+	}
+	return path, ""
+}
+
+func (rt *router) add(entry *muxEntry) error {
+	host, path := SplitRoute(entry.path)
+	var pathRe *regexp.Regexp
+	if len(path) > 0 && isRegexp(path[1:]) {
+		var err error
+		if pathRe, err = regexp.Compile(path[2:]); err != nil {
+			return err
+		}
+	}
+	routes, err := rt.routes(host, true)
+	if err != nil {
+		return err
+	}
+	if pathRe != nil {
+		routes.regexps = append(routes.regexps, &pathRegexp{re: pathRe, entry: entry})
+		return nil
+	}
+	routes.add(path, entry)
+	return nil
+}
+
+func (rt *router) remove(entry *muxEntry) {
+	host, path := SplitRoute(entry.path)
+	routes, _ := rt.routes(host, false)
+	if routes == nil || !routes.remove(path, entry) {
+		return
+	}
+	switch {
+	case !IsPattern(host):
+		delete(rt.hosts, host)
+	case isSuffixWildcard(host):
+		rt.suffixes.remove(suffixLabels(host))
+	case isRegexp(host):
+		for i, r := range rt.regexps {
+			if r.pattern == host {
+				rt.regexps = append(rt.regexps[:i], rt.regexps[i+1:]...)
+				break
+			}
+		}
+	default:
+		for i, p := range rt.patterns {
+			if p.pattern == host {
+				rt.patterns = append(rt.patterns[:i], rt.patterns[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// routes returns the path trie of a hostname, creating it if create is true
+func (rt *router) routes(host string, create bool) (*pathNode, error) {
+	switch {
+	case !IsPattern(host):
+		routes := rt.hosts[host]
+		if routes == nil && create {
+			if rt.hosts == nil {
+				rt.hosts = make(map[string]*pathNode)
+			}
+			routes = new(pathNode)
+			rt.hosts[host] = routes
+		}
+		return routes, nil
+
+	case isSuffixWildcard(host):
+		node := &rt.suffixes
+		for _, label := range suffixLabels(host) {
+			child := node.children[label]
+			if child == nil {
+				if !create {
+					return nil, nil
+				}
+				if node.children == nil {
+					node.children = make(map[string]*hostNode)
+				}
+				child = new(hostNode)
+				node.children[label] = child
+			}
+			node = child
+		}
+		if node.routes == nil && create {
+			node.pattern = host
+			node.routes = new(pathNode)
+		}
+		return node.routes, nil
+
+	case isRegexp(host):
+		for _, r := range rt.regexps {
+			if r.pattern == host {
+				return r.routes, nil
+			}
+		}
+		if !create {
+			return nil, nil
+		}
+		re, err := regexp.Compile(host[1:])
+		if err != nil {
+			return nil, err
+		}
+		r := &hostRegexp{pattern: host, re: re, routes: new(pathNode)}
+		rt.regexps = append(rt.regexps, r)
+		return r.routes, nil
+
+	default:
+		for _, p := range rt.patterns {
+			if p.pattern == host {
+				return p.routes, nil
+			}
+		}
+		if !create {
+			return nil, nil
+		}
+		p := &hostPattern{pattern: host, routes: new(pathNode)}
+		rt.patterns = append(rt.patterns, p)
+		sort.SliceStable(rt.patterns, func(i, j int) bool {
+			return len(rt.patterns[i].pattern) > len(rt.patterns[j].pattern)
+		})
+		return p.routes, nil
+	}
+}
+
+// suffixLabels returns the labels of a *.domain wildcard from right to left
+func suffixLabels(host string) []string {
+	labels := strings.Split(host[2:], ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// match returns the entry of a request path that starts with the hostname,
+// and the submatches of regular expressions by name and by index.
+// Entries rejected by accept are skipped, a nil accept accepts all entries.
+func (rt *router) match(route string, accept func(*muxEntry) bool) (*muxEntry, map[string]string) {
+	host, path := SplitRoute(route)
+	if routes := rt.hosts[host]; routes != nil {
+		if entry, captures := routes.match(path, accept); entry != nil {
+			return entry, captures
+		}
+	}
+	host = stripPort(host)
+	if routes := rt.hosts[host]; routes != nil {
+		if entry, captures := routes.match(path, accept); entry != nil {
+			return entry, captures
+		}
+	}
+	if entry, captures := rt.suffixes.match(host, path, accept); entry != nil {
+		return entry, captures
+	}
+	for _, r := range rt.regexps {
+		if submatches := r.re.FindStringSubmatch(host); submatches != nil {
+			if entry, captures := r.routes.match(path, accept); entry != nil {
+				return entry, addCaptures(captures, r.re, submatches)
+			}
+		}
+	}
+	for _, p := range rt.patterns {
+		if matchPattern(p.pattern, host) {
+			if entry, captures := p.routes.match(path, accept); entry != nil {
+				return entry, captures
+			}
+		}
+	}
+	return nil, nil
+}
+
+func accepts(accept func(*muxEntry) bool, entry *muxEntry) bool {
+	return entry != nil && (accept == nil || accept(entry))
+}
+
+// addCaptures adds the submatches of re to captures, unless they are already set by a path regexp
+func addCaptures(captures map[string]string, re *regexp.Regexp, submatches []string) map[string]string {
+	if captures == nil {
+		captures = make(map[string]string, len(submatches))
+	}
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		if _, ok := captures[strconv.Itoa(i)]; !ok {
+			captures[strconv.Itoa(i)] = submatches[i]
+		}
+		if _, ok := captures[name]; len(name) > 0 && !ok {
+			captures[name] = submatches[i]
+		}
+	}
+	return captures
+}
+
+// matchHost returns the hostname of the entries matching host in order of precedence,
+// which is host itself if it has an exact entry
+func (rt *router) matchHost(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if rt.hosts[host] != nil {
+		return host, true
+	}
+	host = stripPort(host)
+	if rt.hosts[host] != nil {
+		return host, true
+	}
+	if pattern, ok := rt.suffixes.matchHost(host); ok {
+		return pattern, true
+	}
+	for _, r := range rt.regexps {
+		if r.re.MatchString(host) {
+			return r.pattern, true
+		}
+	}
+	for _, p := range rt.patterns {
+		if matchPattern(p.pattern, host) {
+			return p.pattern, true
+		}
+	}
+	return "", false
+}
+
+// match walks the labels of host from right to left and tries the deepest wildcard first.
+// A wildcard has to match at least one label, so *.example.com doesn't match example.com.
+func (n *hostNode) match(host, path string, accept func(*muxEntry) bool) (*muxEntry, map[string]string) {
+	var label string
+	rest := host
+	if i := strings.LastIndexByte(host, '.'); i >= 0 {
+		label, rest = host[i+1:], host[:i]
+	} else {
+		label, rest = host, ""
+	}
+	if len(host) > 0 {
+		if child := n.children[label]; child != nil && len(rest) > 0 {
+			if entry, captures := child.match(rest, path, accept); entry != nil {
+				return entry, captures
+			}
+		}
+	}
+	if n.routes != nil && len(host) > 0 {
+		return n.routes.match(path, accept)
+	}
+	return nil, nil
+}
+
+func (n *hostNode) matchHost(host string) (string, bool) {
+	if i := strings.LastIndexByte(host, '.'); i >= 0 {
+		if child := n.children[host[i+1:]]; child != nil {
+			if pattern, ok := child.matchHost(host[:i]); ok {
+				return pattern, true
+			}
+		}
+	}
+	return n.pattern, n.routes != nil && len(host) > 0
+}
+
+func (n *hostNode) remove(labels []string) bool {
+	if len(labels) == 0 {
+		n.pattern = ""
+		n.routes = nil
+	} else if child := n.children[labels[0]]; child != nil && child.remove(labels[1:]) {
+		delete(n.children, labels[0])
+	}
+	return n.routes == nil && len(n.children) == 0
+}
+
+func (n *pathNode) add(path string, entry *muxEntry) {
+	if len(path) <= 1 {
+		if len(path) == 1 {
+			n.dirEntry = entry
+		} else {
+			n.entry = entry
+		}
+		return
+	}
+	segment, rest := cutSegment(path)
+	n.child(segment).add(rest, entry)
+}
+
+func (n *pathNode) child(segment string) *pathNode {
+	if IsPattern(segment) {
+		for _, child := range n.patterns {
+			if child.segment == segment {
+				return child
+			}
+		}
+		child := &pathNode{segment: segment}
+		n.patterns = append(n.patterns, child)
+		return child
+	}
+	child := n.static[segment]
+	if child == nil {
+		if n.static == nil {
+			n.static = make(map[string]*pathNode)
+		}
+		child = new(pathNode)
+		n.static[segment] = child
+	}
+	return child
+}
+
+// remove removes the entry and returns whether the node became empty.
+// /~regex paths are only stored in the root node, like router.add does.
+func (n *pathNode) remove(path string, entry *muxEntry) bool {
+	if len(path) > 1 && isRegexp(path[1:]) {
+		for i, r := range n.regexps {
+			if r.entry == entry {
+				n.regexps = append(n.regexps[:i], n.regexps[i+1:]...)
+				break
+			}
+		}
+	} else if len(path) <= 1 {
+		if n.dirEntry == entry {
+			n.dirEntry = nil
+		}
+		if n.entry == entry {
+			n.entry = nil
+		}
+	} else if segment, rest := cutSegment(path); IsPattern(segment) {
+		for i, child := range n.patterns {
+			if child.segment == segment && child.remove(rest, entry) {
+				n.patterns = append(n.patterns[:i], n.patterns[i+1:]...)
+				break
+			}
+		}
+	} else if child := n.static[segment]; child != nil && child.remove(rest, entry) {
+		delete(n.static, segment)
+	}
+	return n.entry == nil && n.dirEntry == nil && len(n.static) == 0 && len(n.patterns) == 0 && len(n.regexps) == 0
+}
+
+// match returns the entry of the first matching regexp or the entry with the longest matching path prefix
+func (n *pathNode) match(path string, accept func(*muxEntry) bool) (*muxEntry, map[string]string) {
+	for _, r := range n.regexps {
+		if submatches := r.re.FindStringSubmatch(path); submatches != nil && accepts(accept, r.entry) {
+			captures := addCaptures(nil, r.re, submatches)
+			captures["0"] = submatches[0]
+			return r.entry, captures
+		}
+	}
+	if len(path) > 1 {
+		segment, rest := cutSegment(path)
+		if child := n.static[segment]; child != nil {
+			if entry, _ := child.match(rest, accept); entry != nil {
+				return entry, nil
+			}
+		}
+		for _, child := range n.patterns {
+			if matchPattern(child.segment, segment) {
+				if entry, _ := child.match(rest, accept); entry != nil {
+					return entry, nil
+				}
+			}
+		}
+	}
+	if len(path) > 0 && accepts(accept, n.dirEntry) {
+		return n.dirEntry, nil
+	}
+	if accepts(accept, n.entry) {
+		return n.entry, nil
+	}
+	return nil, nil
+}
+
+func matchPattern(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
@@ -0,0 +1,231 @@
+package mux
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterPrecedence(t *testing.T) {
+	var m Mux
+	for _, path := range []string{
+		"~^(www|cdn)\\.example\\.com$",
+		"ex*.com",
+		"*.com",
+		"*.example.com",
+		"*.api.example.com",
+		"example.com",
+		"example.com/api",
+		"example.com/api/v1",
+		"example.com/static/",
+		"example.com/*/files",
+		"example.com/assets/files",
+		"example.com:8080/admin",
+	} {
+		m.Add(path, nil, "")
+	}
+	tests := []struct {
+		request, want string
+	}{
+		{"example.com/", "example.com"},
+		{"EXAMPLE.com/index.html", "example.com"},
+		{"example.com/api", "example.com/api"},
+		{"example.com/api/users", "example.com/api"},
+		{"example.com/api/v1/users", "example.com/api/v1"},
+		{"example.com/apiv2", "example.com"}, // prefixes match on segment boundaries
+		{"example.com/static", "example.com"},
+		{"example.com/static/app.js", "example.com/static/"},
+		{"example.com/docs/files", "example.com/*/files"},
+		{"example.com/assets/files", "example.com/assets/files"}, // static segments before glob segments
+		{"example.com:8080/admin", "example.com:8080/admin"},
+		{"example.com:8080/", "example.com"}, // exact hostname with port first, then without
+		{"example.com:9090/admin", "example.com"},
+		{"www.example.com/", "*.example.com"}, // wildcard before regexp
+		{"a.api.example.com/", "*.api.example.com"},
+		{"api.example.com/", "*.example.com"}, // a wildcard needs at least one label
+		{"example.net/", ""},
+		{"exact.com/", "*.com"}, // wildcard before glob
+		{"exa.org/", ""},
+	}
+	for _, tt := range tests {
+		entry, _ := m.router.match(tt.request, nil)
+		var got string
+		if entry != nil {
+			got = entry.path
+		}
+		if got != tt.want {
+			t.Errorf("%s matched %q, want %q", tt.request, got, tt.want)
+		}
+	}
+}
+
+func TestRouterRegexpPrecedence(t *testing.T) {
+	var m Mux
+	for _, path := range []string{
+		"~^(www|cdn)\\.example\\.org$",
+		"ex?mple.org",
+		"example.org/~^/u/(?P<user>[^/]+)$",
+		"example.org/u",
+	} {
+		m.Add(path, nil, "")
+	}
+	tests := []struct {
+		request, want string
+	}{
+		{"cdn.example.org/", "~^(www|cdn)\\.example\\.org$"}, // regexp before glob
+		{"example.org/u/alice", "example.org/~^/u/(?P<user>[^/]+)$"},
+		{"example.org/u/alice/x", "example.org/u"},
+		{"example.org/", "ex?mple.org"}, // the next hostname is tried if no path matches
+		{"exbmple.org/u/alice", "ex?mple.org"},
+	}
+	for _, tt := range tests {
+		entry, _ := m.router.match(tt.request, nil)
+		var got string
+		if entry != nil {
+			got = entry.path
+		}
+		if got != tt.want {
+			t.Errorf("%s matched %q, want %q", tt.request, got, tt.want)
+		}
+	}
+}
+
+func TestShadowedBy(t *testing.T) {
+	var m Mux
+	for _, path := range []string{"example.com", "example.com/api", "example.com/~^/admin", "example.com/admin/users", "*.example.com"} {
+		m.Add(path, nil, "")
+	}
+	if other, ok := m.ShadowedBy("example.com/admin/users"); !ok || other != "example.com/~^/admin" {
+		t.Errorf("path shadowed by a regexp path is not reported: %q %v", other, ok)
+	}
+	for _, path := range []string{"example.com", "example.com/api", "*.example.com"} {
+		if other, ok := m.ShadowedBy(path); ok {
+			t.Errorf("%s reported as shadowed by %s", path, other)
+		}
+	}
+}
+
+const benchRoutes = 10000
+
+func benchmarkMux(b *testing.B, route func(i int) string, request func(i int) string) {
+	var m Mux
+	for i := 0; i < benchRoutes; i++ {
+		m.Add(route(i), nil, "")
+	}
+	requests := make([]*http.Request, 256)
+	for i := range requests {
+		requests[i] = httptest.NewRequest("GET", "http://"+request(i*benchRoutes/len(requests)), nil)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := requests[i%len(requests)]
+		if m.Handler(r) == nil {
+			b.Fatal("no match for", r.Host+r.URL.Path)
+		}
+	}
+}
+
+func BenchmarkMuxExactHosts(b *testing.B) {
+	benchmarkMux(b,
+		func(i int) string { return fmt.Sprintf("host%d.example.com", i) },
+		func(i int) string { return fmt.Sprintf("host%d.example.com/index.html", i) })
+}
+
+func BenchmarkMuxPaths(b *testing.B) {
+	benchmarkMux(b,
+		func(i int) string { return fmt.Sprintf("example.com/api/v%d/resource%d", i%10, i) },
+		func(i int) string { return fmt.Sprintf("example.com/api/v%d/resource%d/items/42", i%10, i) })
+}
+
+func BenchmarkMuxWildcards(b *testing.B) {
+	benchmarkMux(b,
+		func(i int) string { return fmt.Sprintf("*.tenant%d.example.com", i) },
+		func(i int) string { return fmt.Sprintf("www.tenant%d.example.com/", i) })
+}
+
+func BenchmarkMuxMixed(b *testing.B) {
+	benchmarkMux(b,
+		func(i int) string {
+			switch i % 3 {
+			case 0:
+				return fmt.Sprintf("host%d.example.com", i)
+			case 1:
+				return fmt.Sprintf("*.wild%d.example.com", i)
+			default:
+				return fmt.Sprintf("paths.example.com/app%d", i)
+			}
+		},
+		func(i int) string {
+			switch i % 3 {
+			case 0:
+				return fmt.Sprintf("host%d.example.com/", i)
+			case 1:
+				return fmt.Sprintf("a.wild%d.example.com/", i)
+			default:
+				return fmt.Sprintf("paths.example.com/app%d/page", i)
+			}
+		})
+}
+
+func TestRouterRemove(t *testing.T) {
+	paths := []string{
+		"example.com",
+		"example.com/api/",
+		"example.com/*/files",
+		"example.com/~^/u/(.*)",
+		"*.example.com",
+		"*.example.com/~^/v[0-9]+/",
+		"~^www\\.example\\.org$",
+		"~^www\\.example\\.org$/~^/x/",
+		"ex*.net",
+	}
+	var m Mux
+	for _, path := range paths {
+		m.Add(path, nil, "a")
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		m.Remove(paths[i], "a")
+		if entry, _ := m.router.match(paths[i], nil); entry != nil && entry.path == paths[i] {
+			t.Errorf("%s still matched after Remove", paths[i])
+		}
+	}
+	if m.Contains("example.com/u/alice") || m.ContainsHost("example.com") || m.ContainsHost("www.example.org") {
+		t.Error("Contains is true after removing every entry")
+	}
+	if len(m.router.hosts) != 0 || len(m.router.suffixes.children) != 0 || len(m.router.regexps) != 0 || len(m.router.patterns) != 0 {
+		t.Errorf("router is not empty after removing every entry: %+v", m.router)
+	}
+}
+
+func TestRouterRemoveRegexpPath(t *testing.T) {
+	const path = "example.com/~^/u/(.*)"
+	var m Mux
+	m.Add(path, nil, "a")
+	if !m.Contains("example.com/u/alice") {
+		t.Fatal("regexp path is not matched")
+	}
+	m.Remove(path, "a")
+	if m.Contains("example.com/u/alice") || m.ContainsHost("example.com") {
+		t.Error("regexp path is still matched after Remove")
+	}
+
+	// reloads remove and add the entry again, which must not pile up regexps
+	for i := 0; i < 3; i++ {
+		m.Add(path, nil, "a")
+		m.Add("example.com/static", nil, "b")
+		m.Remove(path, "a")
+	}
+	if n := len(m.router.hosts["example.com"].regexps); n != 0 {
+		t.Errorf("%d regexps left after removing the path", n)
+	}
+	m.Add(path, nil, "a")
+	m.Add(path, nil, "b")
+	m.Remove(path, "a")
+	if !m.Contains("example.com/u/alice") {
+		t.Error("regexp path is removed while it still has a handler")
+	}
+	if n := len(m.router.hosts["example.com"].regexps); n != 1 {
+		t.Errorf("%d regexps after adding the path twice, want 1", n)
+	}
+}
@@ -0,0 +1,93 @@
+package mux
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultStickyCookie is the cookie name of sticky sessions if the config doesn't name one
+const DefaultStickyCookie = "razvhost_backend"
+
+var stickySecret atomic.Pointer[[]byte]
+
+func init() {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	stickySecret.Store(&secret)
+}
+
+// SetStickySecret sets the key that sticky session cookies are signed with.
+// By default a random key is used, so cookies are only valid until the process exits.
+func SetStickySecret(secret []byte) {
+	stickySecret.Store(&secret)
+}
+
+// stickyToken identifies a handler in cookies without revealing its ID, which can contain credentials
+func stickyToken(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func signToken(token string) string {
+	mac := hmac.New(sha256.New, *stickySecret.Load())
+	mac.Write([]byte(token))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verifyCookie returns the token of a cookie value if its signature is valid
+func verifyCookie(value string) (string, bool) {
+	token, _, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	return token, hmac.Equal([]byte(value), []byte(signToken(token)))
+}
+
+// stickyHandler returns the candidate pinned by the sticky cookie of the request
+func (b *balancer) stickyHandler(r *http.Request, candidates []*muxHandler) *muxHandler {
+	cookie, err := r.Cookie(b.sticky)
+	if err != nil {
+		return nil
+	}
+	token, ok := verifyCookie(cookie.Value)
+	if !ok {
+		return nil
+	}
+	for _, h := range candidates {
+		if h.token == token {
+			return h
+		}
+	}
+	return nil
+}
+
+// setStickyCookie pins the client to h, replacing the cookie set by a previous attempt
+func (b *balancer) setStickyCookie(w http.ResponseWriter, r *http.Request, h *muxHandler) {
+	if cookie, err := r.Cookie(b.sticky); err == nil && cookie.Value == signToken(h.token) {
+		return
+	}
+	header := w.Header()
+	cookies := header["Set-Cookie"][:0]
+	for _, cookie := range header["Set-Cookie"] {
+		if !strings.HasPrefix(cookie, b.sticky+"=") {
+			cookies = append(cookies, cookie)
+		}
+	}
+	header["Set-Cookie"] = cookies
+	http.SetCookie(w, &http.Cookie{
+		Name:     b.sticky,
+		Value:    signToken(h.token),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,174 @@
+package mux
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy selects the handler to serve a request from the healthy candidates of an entry
+type Strategy interface {
+	Pick(r *http.Request, candidates []*muxHandler) *muxHandler
+}
+
+// NewStrategy returns a load balancing strategy by name:
+//   - round-robin: smooth weighted round-robin (the default)
+//   - least-conn: the fewest outstanding requests relative to weight
+//   - random-two: the less loaded of two random candidates
+//   - ip-hash: consistent hashing on the client IP
+//   - hash: consistent hashing on key, which is header:<name>, cookie:<name> or ip
+func NewStrategy(name, key string) (Strategy, error) {
+	if len(key) > 0 && name != "hash" {
+		return nil, fmt.Errorf("lb.key is only supported by the hash strategy")
+	}
+	switch name {
+	case "", "round-robin":
+		return &roundRobin{}, nil
+	case "least-conn":
+		return &leastConn{}, nil
+	case "random-two":
+		return randomTwo{}, nil
+	case "ip-hash":
+		return &hashStrategy{key: clientIP}, nil
+	case "hash":
+		keyFunc, err := newHashKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &hashStrategy{key: keyFunc}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy: %s", name)
+	}
+}
+
+// roundRobin is nginx's smooth weighted round-robin
+type roundRobin struct {
+	mtx sync.Mutex
+}
+
+func (s *roundRobin) Pick(r *http.Request, candidates []*muxHandler) *muxHandler {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var best *muxHandler
+	var bestWeight, total int64
+	for _, h := range candidates {
+		weight := h.state.currentWeight.Add(int64(h.weight))
+		total += int64(h.weight)
+		if best == nil || weight > bestWeight {
+			best, bestWeight = h, weight
+		}
+	}
+	if best != nil {
+		best.state.currentWeight.Add(-total)
+	}
+	return best
+}
+
+type leastConn struct {
+	next uint32
+}
+
+func (s *leastConn) Pick(r *http.Request, candidates []*muxHandler) *muxHandler {
+	// start at a rotating offset, so ties are spread evenly
+	offset := int(atomic.AddUint32(&s.next, 1))
+	var best *muxHandler
+	for i := range candidates {
+		h := candidates[(offset+i)%len(candidates)]
+		if best == nil || h.load() < best.load() {
+			best = h
+		}
+	}
+	return best
+}
+
+type randomTwo struct{}
+
+func (randomTwo) Pick(r *http.Request, candidates []*muxHandler) *muxHandler {
+	if len(candidates) < 2 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if candidates[j].load() < candidates[i].load() {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// hashStrategy uses weighted rendezvous hashing, so only the requests of a removed
+// or unhealthy handler move to other handlers. Requests without a key are served round-robin.
+type hashStrategy struct {
+	key      func(r *http.Request) string
+	fallback roundRobin
+}
+
+func (s *hashStrategy) Pick(r *http.Request, candidates []*muxHandler) *muxHandler {
+	key := s.key(r)
+	if len(key) == 0 {
+		return s.fallback.Pick(r, candidates)
+	}
+	var best *muxHandler
+	var bestScore float64
+	for _, h := range candidates {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(h.id))
+		// map the hash to (0,1) and weight it
+		x := (float64(mix(hash.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -float64(h.weight) / math.Log(x)
+		if best == nil || score > bestScore {
+			best, bestScore = h, score
+		}
+	}
+	return best
+}
+
+// mix is the splitmix64 finalizer. FNV alone doesn't spread the last bytes of the input to the high bits.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func newHashKey(key string) (func(r *http.Request) string, error) {
+	kind, name, _ := strings.Cut(key, ":")
+	switch {
+	case kind == "ip" && len(name) == 0:
+		return clientIP, nil
+	case kind == "header" && len(name) > 0:
+		return func(r *http.Request) string {
+			return r.Header.Get(name)
+		}, nil
+	case kind == "cookie" && len(name) > 0:
+		return func(r *http.Request) string {
+			if cookie, err := r.Cookie(name); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}, nil
+	default:
+		return nil, fmt.Errorf("bad lb.key, expected header:<name>, cookie:<name> or ip: %s", key)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
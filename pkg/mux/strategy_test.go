@@ -0,0 +1,206 @@
+package mux
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testHandlers(weights ...int) []*muxHandler {
+	handlers := make([]*muxHandler, len(weights))
+	for i, w := range weights {
+		handlers[i] = &muxHandler{id: fmt.Sprintf("t%d", i), weight: w, state: new(BackendState)}
+	}
+	return handlers
+}
+
+func pickCounts(s Strategy, r *http.Request, candidates []*muxHandler, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[s.Pick(r, candidates).id]++
+	}
+	return counts
+}
+
+func TestRoundRobinWeights(t *testing.T) {
+	s, _ := NewStrategy("round-robin", "")
+	handlers := testHandlers(5, 1, 1)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// smooth: the heavy target is interleaved with the others instead of picked 5 times in a row
+	var seq string
+	for i := 0; i < 7; i++ {
+		seq += s.Pick(r, handlers).id[1:]
+	}
+	if seq != "0010200" {
+		t.Errorf("sequence = %s, want 0010200", seq)
+	}
+
+	counts := pickCounts(s, r, handlers, 7000)
+	for id, want := range map[string]int{"t0": 5000, "t1": 1000, "t2": 1000} {
+		if counts[id] != want {
+			t.Errorf("%s picked %d times, want %d", id, counts[id], want)
+		}
+	}
+}
+
+func TestRoundRobinSharedState(t *testing.T) {
+	// a mux rebuilt with the states of the backends continues the sequence of the previous one
+	states := []*BackendState{new(BackendState), new(BackendState), new(BackendState)}
+	newMux := func() *Mux {
+		m := new(Mux)
+		for i, w := range []int{5, 1, 1} {
+			m.AddBackend("example.com", Backend{ID: fmt.Sprintf("t%d", i), Weight: w, State: states[i]})
+		}
+		return m
+	}
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	var seq string
+	m := newMux()
+	for i := 0; i < 7; i++ {
+		if i == 3 {
+			m = newMux()
+		}
+		entry, _ := m.router.match("example.com/", nil)
+		seq += entry.strategy.Pick(r, entry.handlers).id[1:]
+	}
+	if seq != "0010200" {
+		t.Errorf("sequence = %s, want 0010200", seq)
+	}
+}
+
+func TestLeastConnPrefersIdle(t *testing.T) {
+	s, _ := NewStrategy("least-conn", "")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	handlers := testHandlers(1, 1, 1)
+	handlers[0].state.inflight.Store(2)
+	handlers[2].state.inflight.Store(1)
+	for i := 0; i < 10; i++ {
+		if h := s.Pick(r, handlers); h != handlers[1] {
+			t.Fatalf("picked %s, want the idle t1", h.id)
+		}
+	}
+
+	// load is relative to weight: 2 requests on weight 4 is less than 1 on weight 1
+	handlers = testHandlers(4, 1)
+	handlers[0].state.inflight.Store(2)
+	handlers[1].state.inflight.Store(1)
+	if h := s.Pick(r, handlers); h != handlers[0] {
+		t.Errorf("picked %s, want t0", h.id)
+	}
+
+	// ties are spread evenly
+	counts := pickCounts(s, r, testHandlers(1, 1, 1), 300)
+	for id, n := range counts {
+		if n != 100 {
+			t.Errorf("%s picked %d times on ties, want 100", id, n)
+		}
+	}
+}
+
+func TestRandomTwo(t *testing.T) {
+	s, _ := NewStrategy("random-two", "")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	single := testHandlers(1)
+	if h := s.Pick(r, single); h != single[0] {
+		t.Fatal("single candidate not picked")
+	}
+
+	handlers := testHandlers(1, 1, 1, 1)
+	counts := pickCounts(s, r, handlers, 40000)
+	for id, n := range counts {
+		if n < 9000 || n > 11000 {
+			t.Errorf("%s picked %d times out of 40000, want about 10000", id, n)
+		}
+	}
+
+	// a busy target is never preferred over an idle one
+	handlers[2].state.inflight.Store(5)
+	counts = pickCounts(s, r, handlers, 10000)
+	if counts["t2"] != 0 {
+		t.Errorf("busy t2 picked %d times", counts["t2"])
+	}
+}
+
+func TestHashStability(t *testing.T) {
+	tests := []struct {
+		name, strategy, key string
+		request             func(i int) *http.Request
+	}{
+		{"ip-hash", "ip-hash", "", func(i int) *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:4321", i/256, i%256)
+			return r
+		}},
+		{"header", "hash", "header:X-User", func(i int) *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-User", fmt.Sprint("user", i))
+			return r
+		}},
+		{"cookie", "hash", "cookie:session", func(i int) *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "session", Value: fmt.Sprint("s", i)})
+			return r
+		}},
+	}
+	const keys = 2000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStrategy(tt.strategy, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handlers := testHandlers(1, 1, 1, 1)
+			before := make([]string, keys)
+			counts := make(map[string]int)
+			for i := range before {
+				before[i] = s.Pick(tt.request(i), handlers).id
+				counts[before[i]]++
+				if again := s.Pick(tt.request(i), handlers).id; again != before[i] {
+					t.Fatalf("key %d moved from %s to %s without changes", i, before[i], again)
+				}
+			}
+			for id, n := range counts {
+				if n < keys/4*3/4 || n > keys/4*5/4 {
+					t.Errorf("%s got %d of %d keys", id, n, keys)
+				}
+			}
+
+			// removing a target only moves its own keys
+			removed := append(append([]*muxHandler(nil), handlers[:1]...), handlers[2:]...)
+			for i := range before {
+				after := s.Pick(tt.request(i), removed).id
+				if before[i] != "t1" && after != before[i] {
+					t.Fatalf("key %d moved from %s to %s when t1 was removed", i, before[i], after)
+				}
+			}
+
+			// adding a target only moves keys to the new one
+			added := append(append([]*muxHandler(nil), handlers...), &muxHandler{id: "t4", weight: 1, state: new(BackendState)})
+			moved := 0
+			for i := range before {
+				after := s.Pick(tt.request(i), added).id
+				if after != before[i] {
+					if after != "t4" {
+						t.Fatalf("key %d moved from %s to %s when t4 was added", i, before[i], after)
+					}
+					moved++
+				}
+			}
+			if moved < keys/5*3/4 || moved > keys/5*5/4 {
+				t.Errorf("%d of %d keys moved to the new target, want about a fifth", moved, keys)
+			}
+		})
+	}
+}
+
+func TestHashWithoutKey(t *testing.T) {
+	s, _ := NewStrategy("hash", "header:X-User")
+	counts := pickCounts(s, httptest.NewRequest("GET", "/", nil), testHandlers(1, 1), 100)
+	if counts["t0"] != 50 || counts["t1"] != 50 {
+		t.Errorf("requests without key are not served round-robin: %v", counts)
+	}
+}
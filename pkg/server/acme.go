@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/dns01"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeDirectories are the shorthands accepted as ACME directory URLs
+var acmeDirectories = map[string]string{
+	"letsencrypt":         acme.LetsEncryptURL,
+	"letsencrypt-staging": "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+}
+
+// ACMEConfig contains the settings of the ACME client that requests certificates
+type ACMEConfig struct {
+	DirectoryURL string // empty for Let's Encrypt
+	Email        string
+	EABKeyID     string // External Account Binding key ID, required by some CAs like ZeroSSL
+	EABKey       []byte
+	KeyType      string         // auto, ecdsa or rsa
+	RootCAs      *x509.CertPool // CAs to verify the ACME server with, nil for the system CAs
+	DNSProvider  dns01.Provider // requests wildcard certificates for *.domain routes if set
+	DNSDelay     time.Duration  // time to wait for DNS-01 challenge records to propagate
+}
+
+// NewACMEConfig returns an ACME config from command line args.
+// The directory can be a URL or one of letsencrypt, letsencrypt-staging and zerossl,
+// the EAB HMAC key is base64url encoded, and caFile is an optional PEM bundle to verify the ACME server with.
+func NewACMEConfig(directory, email, eabKeyID, eabHMAC, keyType, caFile string) (ACMEConfig, error) {
+	cfg := ACMEConfig{
+		DirectoryURL: directory,
+		Email:        email,
+		EABKeyID:     eabKeyID,
+		KeyType:      strings.ToLower(keyType),
+	}
+	if known, ok := acmeDirectories[strings.ToLower(directory)]; ok {
+		cfg.DirectoryURL = known
+	} else if len(directory) > 0 {
+		u, err := url.Parse(directory)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return cfg, fmt.Errorf("bad ACME directory URL: %s", directory)
+		}
+	}
+	if (len(eabKeyID) > 0) != (len(eabHMAC) > 0) {
+		return cfg, fmt.Errorf("both the EAB key ID and HMAC key have to be given")
+	}
+	if len(eabHMAC) > 0 {
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(eabHMAC, "="))
+		if err != nil {
+			return cfg, fmt.Errorf("bad EAB HMAC key: %v", err)
+		}
+		cfg.EABKey = key
+	}
+	switch cfg.KeyType {
+	case "":
+		cfg.KeyType = "auto"
+	case "auto", "ecdsa", "rsa":
+	default:
+		return cfg, fmt.Errorf("unknown certificate key type: %s (expected auto, ecdsa or rsa)", keyType)
+	}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return cfg, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+// cacheDir returns the directory to store the certificates of the ACME directory in.
+// Let's Encrypt certificates are stored in certsDir, others in a subdirectory named after the directory host,
+// so switching between CAs (e.g. staging and production) never serves a certificate of the other one.
+func (c ACMEConfig) cacheDir(certsDir string) string {
+	if len(c.DirectoryURL) == 0 || c.DirectoryURL == acme.LetsEncryptURL {
+		return certsDir
+	}
+	u, err := url.Parse(c.DirectoryURL)
+	if err != nil {
+		return certsDir
+	}
+	return filepath.Join(certsDir, strings.ReplaceAll(u.Host, ":", "_"))
+}
+
+func (c ACMEConfig) client() *acme.Client {
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if len(client.DirectoryURL) == 0 {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if c.RootCAs != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: c.RootCAs}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	return client
+}
+
+// withKeyType returns the ClientHello that makes autocert pick the configured key type.
+// autocert issues ECDSA certificates for clients supporting them and RSA for the others.
+func (c ACMEConfig) withKeyType(hello *tls.ClientHelloInfo) *tls.ClientHelloInfo {
+	h := *hello
+	switch c.KeyType {
+	case "rsa":
+		h.SignatureSchemes = []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256}
+	case "ecdsa":
+		h.SignatureSchemes = nil
+		h.SupportedCurves = nil
+		h.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	default:
+		return hello
+	}
+	return &h
+}
+
+// initCertManagers sets up the ACME certificate managers. They live as long as the server, since autocert keeps
+// renewing the certificates it has loaded, and a replaced manager would keep renewing them too.
+func (s *Server) initCertManagers() {
+	cache := s.certCache()
+	s.acmeAccount = newACMEAccount(s.config.ACME, cache)
+	s.certManager = s.newAutocertManager(cache)
+	if s.config.ACME.DNSProvider != nil {
+		s.wildcardCerts = newWildcardIssuer(s.config.ACME, cache, s.acmeAccount)
+	}
+}
+
+func (s *Server) certCache() autocert.DirCache {
+	return autocert.DirCache(s.config.ACME.cacheDir(s.config.CertsDir))
+}
+
+func (s *Server) newAutocertManager(cache autocert.Cache) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      cache,
+		HostPolicy: s.ValidateHost,
+		Client:     s.config.ACME.client(),
+		Email:      s.config.ACME.Email,
+	}
+	if len(s.config.ACME.EABKeyID) > 0 {
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: s.config.ACME.EABKeyID,
+			Key: s.config.ACME.EABKey,
+		}
+	}
+	return m
+}
+
+// acmeAccount is the ACME client of the certificates requested outside autocert (wildcard certificates and
+// renewals on request), registered with the account key shared with autocert
+type acmeAccount struct {
+	config ACMEConfig
+	cache  autocert.Cache
+	mtx    sync.Mutex
+	client *acme.Client
+}
+
+func newACMEAccount(config ACMEConfig, cache autocert.Cache) *acmeAccount {
+	return &acmeAccount{
+		config: config,
+		cache:  cache,
+	}
+}
+
+// acmeClient returns the registered ACME client, registering the account on first use
+func (a *acmeAccount) acmeClient(ctx context.Context) (*acme.Client, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.client != nil {
+		return a.client, nil
+	}
+
+	client := a.config.client()
+	data, err := a.cache.Get(ctx, acmeAccountKeyName)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("bad ACME account key")
+		}
+		if client.Key, err = parsePrivateKey(block); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, autocert.ErrCacheMiss):
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.cache.Put(ctx, acmeAccountKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, err
+		}
+		client.Key = key
+	default:
+		return nil, err
+	}
+
+	account := &acme.Account{}
+	if len(a.config.Email) > 0 {
+		account.Contact = []string{"mailto:" + a.config.Email}
+	}
+	if len(a.config.EABKeyID) > 0 {
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: a.config.EABKeyID, Key: a.config.EABKey}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+	a.client = client
+	return client, nil
+}
+
+// orderCertificate requests a certificate for a domain. The authorizations of the order are completed by authorize.
+func orderCertificate(ctx context.Context, client *acme.Client, domain string, isRSA bool,
+	authorize func(ctx context.Context, authzURL string) error) (*tls.Certificate, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := authorize(ctx, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	if isRSA {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: der, PrivateKey: key}
+	if cert.Leaf, err = x509.ParseCertificate(der[0]); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
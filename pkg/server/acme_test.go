@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACMEIssuance(t *testing.T) {
+	ecdsaClient := &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}
+	rsaClient := &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	tests := []struct {
+		keyType, clientName string
+		client              *tls.Config
+		want                x509.PublicKeyAlgorithm
+		cached              string
+	}{
+		{"auto", "ecdsa client", ecdsaClient, x509.ECDSA, "example.com"},
+		{"auto", "rsa client", rsaClient, x509.RSA, "example.com+rsa"},
+		{"ecdsa", "ecdsa client", ecdsaClient, x509.ECDSA, "example.com"},
+		{"rsa", "ecdsa client", ecdsaClient, x509.RSA, "example.com+rsa"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyType+"/"+tt.clientName, func(t *testing.T) {
+			ca := newTestCA(t, "tls-alpn-01")
+			ca.eabKID, ca.eabKey = "kid-1", []byte("0123456789abcdef0123456789abcdef")
+			s := newTestACMEServer(t, ca, ca.acmeConfig(t, tt.keyType), "example.com")
+			cert, err := testHandshakeConfig(s.getCertificate, tt.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.PublicKeyAlgorithm != tt.want {
+				t.Errorf("%s certificate issued, want %s", cert.PublicKeyAlgorithm, tt.want)
+			}
+			if _, err := cert.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: ca.rootPool()}); err != nil {
+				t.Error(err)
+			}
+
+			// stored in the directory of the CA
+			dir := s.config.ACME.cacheDir(s.config.CertsDir)
+			if dir == s.config.CertsDir {
+				t.Fatalf("certificates of %s stored in the Let's Encrypt directory", s.config.ACME.DirectoryURL)
+			}
+			if _, err := os.Stat(filepath.Join(dir, tt.cached)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestACMEExternalAccountBinding(t *testing.T) {
+	tests := []struct {
+		name   string
+		kid    string
+		key    []byte
+		issued bool
+	}{
+		{"valid", "kid-1", []byte("0123456789abcdef0123456789abcdef"), true},
+		{"wrong key", "kid-1", []byte("fedcba9876543210fedcba9876543210"), false},
+		{"wrong key ID", "kid-2", []byte("0123456789abcdef0123456789abcdef"), false},
+		{"missing", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := newTestCA(t, "tls-alpn-01")
+			ca.eabKID, ca.eabKey = tt.kid, tt.key
+			acme := ca.acmeConfig(t, "auto")
+			ca.eabKID, ca.eabKey = "kid-1", []byte("0123456789abcdef0123456789abcdef")
+			s := newTestACMEServer(t, ca, acme, "example.com")
+			_, err := testHandshake(s.getCertificate, "example.com")
+			if (err == nil) != tt.issued {
+				t.Errorf("handshake error: %v, want issued=%v", err, tt.issued)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/razzie/razvhost/pkg/listener"
+)
+
+// Admin serves the admin interface on addr
+func (s *Server) Admin(addr string) error {
+	ln, err := listener.Listen("admin", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Admin interface listening on", addr)
+	return s.serve(&http.Server{Handler: s.adminAuth(s.adminHandler())}, ln, "admin", false)
+}
+
+// adminAuth requires the admin token as bearer token if it is set. Without a token, the admin interface is
+// read-only for remote clients, and certificates can only be renewed or revoked from loopback addresses.
+func (s *Server) adminAuth(handler http.Handler) http.Handler {
+	token := s.config.AdminToken
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(token) > 0 {
+			reqToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="razvhost"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		} else if r.Method != http.MethodGet && r.Method != http.MethodHead && !isLocalRequest(r) {
+			http.Error(w, "Forbidden: an admin token is required for remote requests", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// isLocalRequest tells whether a request comes from a loopback address or a unix socket
+func isLocalRequest(r *http.Request) bool {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Status())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Stats())
+	})
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Certificates())
+	})
+	mux.HandleFunc("/certs/renew", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cert, err := s.RenewCertificate(r.Context(), r.URL.Query().Get("name"))
+		if err != nil {
+			writeCertError(w, err)
+			return
+		}
+		writeJSON(w, cert)
+	})
+	mux.HandleFunc("/certs/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.RevokeCertificate(r.Context(), r.URL.Query().Get("name")); err != nil {
+			writeCertError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeCertificateMetrics(w, s.Certificates())
+	})
+	return mux
+}
+
+func writeCertError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnknownCertificate) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Println("Admin interface error:", err)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		token, method, path, remoteAddr, auth string
+		status                                int
+	}{
+		{"", "GET", "/certs", "192.0.2.1:1234", "", http.StatusOK},
+		{"", "POST", "/certs/renew?name=example.com", "192.0.2.1:1234", "", http.StatusForbidden},
+		{"", "POST", "/certs/revoke?name=example.com", "[2001:db8::1]:1234", "", http.StatusForbidden},
+		{"", "POST", "/certs/renew?name=example.com", "127.0.0.1:1234", "", http.StatusNotFound},
+		{"", "POST", "/certs/revoke?name=example.com", "[::1]:1234", "", http.StatusNotFound},
+		{"secret", "GET", "/certs", "127.0.0.1:1234", "", http.StatusUnauthorized},
+		{"secret", "GET", "/certs", "127.0.0.1:1234", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "GET", "/certs", "192.0.2.1:1234", "Bearer secret", http.StatusOK},
+		{"secret", "POST", "/certs/renew?name=example.com", "192.0.2.1:1234", "Bearer secret", http.StatusNotFound},
+		{"secret", "POST", "/certs/revoke?name=example.com", "192.0.2.1:1234", "Basic secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		s := &Server{config: ServerConfig{CertsDir: t.TempDir(), AdminToken: tt.token}}
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.RemoteAddr = tt.remoteAddr
+		if len(tt.auth) > 0 {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		s.adminAuth(s.adminHandler()).ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s from %s with token %q and auth %q: %d, want %d", tt.method, tt.path, tt.remoteAddr,
+				tt.token, tt.auth, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certWarnBefore is when expiring certificates are logged. ACME certificates are renewed 30 days before expiry,
+// so a certificate expiring sooner wasn't renewed.
+const certWarnBefore = 20 * 24 * time.Hour
+
+// ErrUnknownCertificate is returned when renewing or revoking a certificate that is not in the cache
+var ErrUnknownCertificate = errors.New("unknown certificate")
+
+// CertificateInfo describes a certificate held by the server
+type CertificateInfo struct {
+	Name      string    `json:"name"`   // ACME cache key or certificate file
+	Source    string    `json:"source"` // acme, wildcard (DNS-01) or file (certificate directive)
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dns_names"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+func newCertificateInfo(name, source string, leaf *x509.Certificate) CertificateInfo {
+	issuer := leaf.Issuer.CommonName
+	if len(issuer) == 0 {
+		issuer = leaf.Issuer.String()
+	}
+	return CertificateInfo{
+		Name:      name,
+		Source:    source,
+		Subject:   leaf.Subject.CommonName,
+		DNSNames:  leaf.DNSNames,
+		Issuer:    issuer,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+}
+
+// ListCertificates returns the ACME certificates stored in certsDir
+func ListCertificates(certsDir string, acmeConfig ACMEConfig) ([]CertificateInfo, error) {
+	dir := acmeConfig.cacheDir(certsDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var certs []CertificateInfo
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !isCertCacheKey(name) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		cert, err := parseCachedCertificate(data)
+		if err != nil {
+			continue
+		}
+		source := "acme"
+		if strings.HasPrefix(name, "_.") {
+			source = "wildcard"
+		}
+		certs = append(certs, newCertificateInfo(name, source, cert.Leaf))
+	}
+	return certs, nil
+}
+
+// isCertCacheKey tells whether a cache key belongs to a certificate, and not to the ACME account key or a challenge
+func isCertCacheKey(key string) bool {
+	return key != acmeAccountKeyName && !strings.HasSuffix(key, "+token") && !strings.HasSuffix(key, "+http-01") &&
+		strings.Contains(key, ".")
+}
+
+// Certificates returns the ACME certificates in the cache and the certificates of certificate directives
+func (s *Server) Certificates() []CertificateInfo {
+	certs, err := ListCertificates(s.config.CertsDir, s.config.ACME)
+	if err != nil {
+		log.Println("Cannot list certificates:", err)
+	}
+	if store := s.staticCerts.Load(); store != nil {
+		for _, cert := range store.certs {
+			certs = append(certs, newCertificateInfo(cert.CertFile, "file", cert.Certificate.Leaf))
+		}
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		return certs[i].Name < certs[j].Name
+	})
+	return certs
+}
+
+// RenewCertificate requests a new ACME certificate in place of a cached one, even if it doesn't expire soon
+func (s *Server) RenewCertificate(ctx context.Context, name string) (CertificateInfo, error) {
+	old, err := s.cachedCertificate(ctx, name)
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	var cert *tls.Certificate
+	source := "acme"
+	if strings.HasPrefix(name, "_.") {
+		source = "wildcard"
+		if s.wildcardCerts == nil {
+			return CertificateInfo{}, fmt.Errorf("%s: DNS-01 challenges are not enabled", name)
+		}
+		cert, err = s.wildcardCerts.renewNow(ctx, "*"+name[1:])
+	} else {
+		cert, err = s.renewACMECertificate(ctx, name, old)
+	}
+	if err != nil {
+		log.Printf("WARNING: certificate %s: renewal failed: %v", name, err)
+		return CertificateInfo{}, err
+	}
+	log.Printf("Certificate %s renewed (expires %s)", name, cert.Leaf.NotAfter.Format("2006-01-02"))
+	return newCertificateInfo(name, source, cert.Leaf), nil
+}
+
+// acmeReplacement is the certificate served in place of a renewed or revoked autocert certificate.
+// autocert keeps serving the certificates it has loaded until their renewal timer finds a newer one in the cache.
+type acmeReplacement struct {
+	name     string
+	cert     *tls.Certificate // nil until a revoked certificate is replaced
+	notAfter time.Time        // expiry of the replaced certificate, after which autocert doesn't serve it anymore
+}
+
+// replacedCertificate returns the certificate to serve in place of one returned by autocert, following repeated
+// renewals. A revoked certificate is replaced on first use if the hostname is still allowed.
+func (s *Server) replacedCertificate(ctx context.Context, cert *tls.Certificate) (*tls.Certificate, error) {
+	for {
+		v, ok := s.acmeReplaced.Load(certFingerprint(cert))
+		if !ok {
+			return cert, nil
+		}
+		r := v.(*acmeReplacement)
+		if r.cert == nil {
+			if err := s.ValidateHost(ctx, strings.TrimSuffix(r.name, "+rsa")); err != nil {
+				return nil, err
+			}
+			return s.renewACMECertificate(ctx, r.name, cert)
+		}
+		cert = r.cert
+	}
+}
+
+// renewACMECertificate requests a new certificate in place of an autocert one. The order is made with the shared
+// ACME account instead of autocert, which cannot be made to forget the certificate it serves, but the challenges are
+// stored in the cache, where the serving autocert manager finds them. The new certificate is stored in the cache,
+// and served in place of the old one until the renewal timer of the old one loads it from the cache.
+func (s *Server) renewACMECertificate(ctx context.Context, name string, old *tls.Certificate) (*tls.Certificate, error) {
+	s.acmeRenewMtx.Lock()
+	defer s.acmeRenewMtx.Unlock()
+	fingerprint := certFingerprint(old)
+	if v, ok := s.acmeReplaced.Load(fingerprint); ok && v.(*acmeReplacement).cert != nil {
+		return v.(*acmeReplacement).cert, nil // a revoked certificate replaced by a concurrent handshake
+	}
+
+	client, err := s.acmeAccount.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	domain, isRSA := strings.CutSuffix(name, "+rsa")
+	var errs []error
+	for _, challengeType := range []string{"tls-alpn-01", "http-01"} {
+		cert, err := orderCertificate(ctx, client, domain, isRSA, func(ctx context.Context, authzURL string) error {
+			return s.authorizeACME(ctx, client, authzURL, domain, challengeType)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", challengeType, err))
+			continue
+		}
+		data, err := encodeCertificate(cert)
+		if err == nil {
+			err = s.certCache().Put(ctx, name, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.acmeReplaced.Store(fingerprint, &acmeReplacement{name: name, cert: cert, notAfter: old.Leaf.NotAfter})
+		return cert, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// authorizeACME completes an authorization with a tls-alpn-01 or http-01 challenge. The challenge response is stored
+// in the cache, which is where autocert looks for the challenges it didn't start itself.
+func (s *Server) authorizeACME(ctx context.Context, client *acme.Client, authzURL, domain, challengeType string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil || authz.Status == acme.StatusValid {
+		return err
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("the CA offered no %s challenge", challengeType)
+	}
+	var key string
+	var data []byte
+	if challengeType == "tls-alpn-01" {
+		cert, err := client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return err
+		}
+		if data, err = encodeCertificate(&cert); err != nil {
+			return err
+		}
+		key = domain + "+token"
+	} else {
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		key, data = challenge.Token+"+http-01", []byte(response)
+	}
+	cache := s.certCache()
+	if err := cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	defer cache.Delete(context.Background(), key)
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// RevokeCertificate revokes a cached ACME certificate and removes it from the cache,
+// so a new one is requested on the next TLS connection
+func (s *Server) RevokeCertificate(ctx context.Context, name string) error {
+	cert, err := s.cachedCertificate(ctx, name)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("%s: unknown private key type", name)
+	}
+	if err := s.config.ACME.client().RevokeCert(ctx, key, cert.Certificate[0], acme.CRLReasonUnspecified); err != nil {
+		return err
+	}
+	if err := s.certCache().Delete(ctx, name); err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, "_.") {
+		if s.wildcardCerts != nil {
+			s.wildcardCerts.forget("*" + name[1:])
+		}
+	} else {
+		s.acmeReplaced.Store(certFingerprint(cert), &acmeReplacement{name: name, notAfter: cert.Leaf.NotAfter})
+	}
+	log.Printf("Certificate %s revoked", name)
+	return nil
+}
+
+// pruneReplacedCertificates drops the replacements of expired certificates, which autocert doesn't serve anymore
+func (s *Server) pruneReplacedCertificates() {
+	now := time.Now()
+	s.acmeReplaced.Range(func(key, value any) bool {
+		if now.After(value.(*acmeReplacement).notAfter) {
+			s.acmeReplaced.Delete(key)
+		}
+		return true
+	})
+}
+
+func certFingerprint(cert *tls.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.Certificate[0])
+}
+
+func (s *Server) cachedCertificate(ctx context.Context, name string) (*tls.Certificate, error) {
+	if s.config.NoCert || !isCertCacheKey(name) || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCertificate, name)
+	}
+	data, err := s.certCache().Get(ctx, name)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCertificate, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseCachedCertificate(data)
+}
+
+// watchCertificates logs the certificates that expire soon every 12 hours
+func (s *Server) watchCertificates() {
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.baseCtx.Done():
+			return
+		}
+		s.checkCertificates()
+		s.pruneReplacedCertificates()
+		timer.Reset(12 * time.Hour)
+	}
+}
+
+// checkCertificates logs the certificates that expire soon. ACME certificates without a route are skipped,
+// since they are not renewed anymore.
+func (s *Server) checkCertificates() {
+	table := s.routes.Load()
+	for _, cert := range s.Certificates() {
+		left := time.Until(cert.NotAfter)
+		if left >= certWarnBefore {
+			continue
+		}
+		hint := "replace the certificate file"
+		if cert.Source != "file" {
+			host := strings.TrimSuffix(cert.Name, "+rsa")
+			if cert.Source == "wildcard" {
+				host = "x" + host[1:] // any subdomain covered by the wildcard
+			}
+			if _, ok := table.mux.HostPattern(host); !ok {
+				continue
+			}
+			hint = "renewal may be failing"
+		}
+		if left <= 0 {
+			log.Printf("WARNING: certificate %s for %s has expired (%s)", cert.Name, strings.Join(cert.DNSNames, ", "), hint)
+		} else {
+			log.Printf("WARNING: certificate %s for %s expires in %d days (%s)", cert.Name, strings.Join(cert.DNSNames, ", "),
+				int(left.Hours()/24), hint)
+		}
+	}
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeCertificateMetrics writes the expiry times of the certificates in the Prometheus text format
+func writeCertificateMetrics(w io.Writer, certs []CertificateInfo) {
+	fmt.Fprintln(w, "# HELP razvhost_certificate_expiry_timestamp_seconds Expiry time of the certificate as Unix timestamp")
+	fmt.Fprintln(w, "# TYPE razvhost_certificate_expiry_timestamp_seconds gauge")
+	for _, cert := range certs {
+		fmt.Fprintf(w, "razvhost_certificate_expiry_timestamp_seconds{name=\"%s\",source=\"%s\",subject=\"%s\"} %d\n",
+			metricLabelEscaper.Replace(cert.Name), cert.Source, metricLabelEscaper.Replace(cert.Subject), cert.NotAfter.Unix())
+	}
+}
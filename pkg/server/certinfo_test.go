@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRenewCertificate(t *testing.T) {
+	for _, challengeType := range []string{"tls-alpn-01", "http-01"} {
+		t.Run(challengeType, func(t *testing.T) {
+			ca := newTestCA(t, challengeType)
+			s := newTestACMEServer(t, ca, ca.acmeConfig(t, "ecdsa"), "example.com")
+			manager := s.certManager
+			first, err := testHandshake(s.getCertificate, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				info, err := s.RenewCertificate(context.Background(), "example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				served, err := testHandshake(s.getCertificate, "example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if served.Equal(first) || !served.NotAfter.Equal(info.NotAfter) {
+					t.Fatalf("renewal %d: old certificate still served", i+1)
+				}
+				cached, err := s.cachedCertificate(context.Background(), "example.com")
+				if err != nil || !cached.Leaf.Equal(served) {
+					t.Fatalf("renewal %d: renewed certificate is not in the cache (%v)", i+1, err)
+				}
+				first = served
+			}
+			if s.certManager != manager {
+				t.Error("certificate manager replaced")
+			}
+			if n := ca.issuedCount(); n != 3 {
+				t.Errorf("%d certificates issued, want 3", n)
+			}
+		})
+	}
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	ca := newTestCA(t, "tls-alpn-01")
+	s := newTestACMEServer(t, ca, ca.acmeConfig(t, "ecdsa"), "example.com", "other.com")
+	revoked, err := testHandshake(s.getCertificate, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeCertificate(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !ca.isRevoked(revoked) {
+		t.Fatal("certificate is not revoked at the CA")
+	}
+	if _, err := s.cachedCertificate(context.Background(), "example.com"); err == nil {
+		t.Fatal("revoked certificate is still in the cache")
+	}
+
+	// replaced on the next connection
+	for i := 0; i < 2; i++ {
+		served, err := testHandshake(s.getCertificate, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if served.Equal(revoked) {
+			t.Fatal("revoked certificate served")
+		}
+	}
+	if n := ca.issuedCount(); n != 2 {
+		t.Errorf("%d certificates issued, want 2", n)
+	}
+
+	// not replaced if the route is gone
+	other, err := testHandshake(s.getCertificate, "other.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeCertificate(context.Background(), "other.com"); err != nil {
+		t.Fatal(err)
+	}
+	setTestRoutes(s, "example.com")
+	if served, err := testHandshake(s.getCertificate, "other.com"); err == nil {
+		t.Errorf("certificate served for a removed route (revoked: %v)", served.Equal(other))
+	}
+}
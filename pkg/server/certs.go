@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"strings"
+
+	"github.com/razzie/razvhost/pkg/config"
+)
+
+// certStore contains the certificates of certificate directives by hostname
+type certStore struct {
+	certs  []config.CertificateConfig
+	byName map[string]*tls.Certificate
+}
+
+func newCertStore(certs []config.CertificateConfig) *certStore {
+	store := &certStore{
+		certs:  certs,
+		byName: make(map[string]*tls.Certificate),
+	}
+	for _, cert := range certs {
+		for _, hostname := range cert.Hostnames {
+			store.byName[hostname] = cert.Certificate
+		}
+	}
+	return store
+}
+
+// get returns the certificate of a hostname or the wildcard certificate of its parent domain
+func (cs *certStore) get(hostname string) *tls.Certificate {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if cert := cs.byName[hostname]; cert != nil {
+		return cert
+	}
+	if i := strings.IndexByte(hostname, '.'); i > 0 {
+		return cs.byName["*"+hostname[i:]]
+	}
+	return nil
+}
+
+// updateCertificates replaces the certificates of certificate directives
+func (s *Server) updateCertificates(certs []config.CertificateConfig) {
+	for _, cert := range certs {
+		log.Printf("Certificate %s for %s (expires %s)", cert.CertFile, strings.Join(cert.Hostnames, ", "),
+			cert.Certificate.Leaf.NotAfter.Format("2006-01-02"))
+	}
+	s.staticCerts.Store(newCertStore(certs))
+}
+
+// getCertificate returns the certificate of a certificate directive, or if there is none, the DNS-01 wildcard
+// certificate of a *.domain route or an ACME certificate of the configured key type
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if store := s.staticCerts.Load(); store != nil {
+		if cert := store.get(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+	}
+	if cert, ok, err := s.wildcardCertificate(hello); ok {
+		return cert, err
+	}
+	cert, err := s.certManager.GetCertificate(s.config.ACME.withKeyType(hello))
+	if err != nil {
+		return nil, err
+	}
+	return s.replacedCertificate(hello.Context(), cert)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// connTracker keeps track of the open connections of listeners, including hijacked ones
+// (e.g. websockets) that http.Server.Shutdown doesn't wait for
+type connTracker struct {
+	mtx   sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[*trackedConn]struct{}),
+	}
+}
+
+func (t *connTracker) listener(ln net.Listener) net.Listener {
+	return &trackingListener{Listener: ln, tracker: t}
+}
+
+func (t *connTracker) count() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return len(t.conns)
+}
+
+func (t *connTracker) closeAll() {
+	t.mtx.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mtx.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (t *connTracker) add(conn *trackedConn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.conns[conn] = struct{}{}
+}
+
+func (t *connTracker) remove(conn *trackedConn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.conns, conn)
+}
+
+type trackingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (ln *trackingListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, tracker: ln.tracker}
+	ln.tracker.add(tc)
+	return tc, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.tracker.remove(c) })
+	return c.Conn.Close()
+}
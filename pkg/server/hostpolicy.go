@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/mux"
+)
+
+// ValidateHost implements autocert.HostPolicy. Hostnames with an exact route are always accepted.
+// Hostnames served by a wildcard route have to match its cert.allow option, or if it has none,
+// they are accepted up to WildcardCertRate per hour, so random SNI names cannot exhaust the CA's rate limits.
+func (s *Server) ValidateHost(ctx context.Context, host string) error {
+	table := s.routes.Load()
+	pattern, ok := table.mux.HostPattern(host)
+	if !ok {
+		return fmt.Errorf("unknown hostname: %s", host)
+	}
+	if !mux.IsPattern(pattern) {
+		return nil
+	}
+	if allow := table.certAllow[pattern]; len(allow) > 0 {
+		for _, p := range allow {
+			if match, _ := path.Match(p, host); match {
+				return nil
+			}
+		}
+		return fmt.Errorf("hostname %s is not allowed by cert.allow of %s", host, pattern)
+	}
+	return s.certRate.allow(host)
+}
+
+// certRateLimiter limits the number of hostnames per hour that certificates are requested for
+type certRateLimiter struct {
+	mtx   sync.Mutex
+	limit int
+	hosts map[string]time.Time // accepted in the last hour, so retries are accepted again
+}
+
+func newCertRateLimiter(limit int) *certRateLimiter {
+	return &certRateLimiter{
+		limit: limit,
+		hosts: make(map[string]time.Time),
+	}
+}
+
+func (l *certRateLimiter) allow(host string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	for h, t := range l.hosts {
+		if now.Sub(t) >= time.Hour {
+			delete(l.hosts, h)
+		}
+	}
+	if _, ok := l.hosts[host]; ok {
+		return nil
+	}
+	if len(l.hosts) >= l.limit {
+		return fmt.Errorf("wildcard certificate rate limit reached, rejecting hostname: %s", host)
+	}
+	l.hosts[host] = now
+	return nil
+}
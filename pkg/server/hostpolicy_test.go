@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testHostPolicyServer(rate int, routes ...string) *Server {
+	s := &Server{certRate: newCertRateLimiter(rate)}
+	table := newRoutingTable()
+	table.certAllow = map[string][]string{
+		"*.allow.com": {"www.allow.com", "*.eu.allow.com"},
+	}
+	for _, route := range routes {
+		table.mux.Add(route, nil, "")
+	}
+	s.routes.Store(table)
+	return s
+}
+
+func TestValidateHost(t *testing.T) {
+	s := testHostPolicyServer(0, "example.com", "example.com:8443/admin", "*.allow.com", "*.rated.com", "~^(a|b)\\.regexp\\.net$")
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"example.com", true},
+		{"unknown.com", false},
+		{"www.allow.com", true},
+		{"x.eu.allow.com", true},
+		{"other.allow.com", false}, // cert.allow overrides the rate limit
+		{"www.rated.com", false},   // rate limit is 0
+		{"a.regexp.net", false},    // regexp hostnames are patterns too
+	}
+	for _, tt := range tests {
+		if err := s.ValidateHost(context.Background(), tt.host); (err == nil) != tt.ok {
+			t.Errorf("ValidateHost(%q) = %v, want ok=%v", tt.host, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateHostRateLimit(t *testing.T) {
+	s := testHostPolicyServer(2, "*.rated.com", "~^(a|b|c)\\.regexp\\.net$")
+	ctx := context.Background()
+	for _, host := range []string{"a.rated.com", "a.regexp.net"} {
+		if err := s.ValidateHost(ctx, host); err != nil {
+			t.Fatalf("ValidateHost(%q) = %v", host, err)
+		}
+	}
+	if err := s.ValidateHost(ctx, "b.rated.com"); err == nil {
+		t.Error("third hostname accepted with a limit of 2 per hour")
+	}
+	if err := s.ValidateHost(ctx, "a.rated.com"); err != nil {
+		t.Errorf("accepted hostname rejected on retry: %v", err)
+	}
+
+	// hostnames accepted more than an hour ago don't count
+	s.certRate.mtx.Lock()
+	s.certRate.hosts["a.rated.com"] = time.Now().Add(-time.Hour - time.Minute)
+	s.certRate.mtx.Unlock()
+	if err := s.ValidateHost(ctx, "b.rated.com"); err != nil {
+		t.Errorf("hostname rejected after the previous one expired: %v", err)
+	}
+	if err := s.ValidateHost(ctx, "c.regexp.net"); err == nil {
+		t.Error("hostname accepted over the limit")
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/listener"
+	"github.com/razzie/razvhost/pkg/logger"
+)
+
+// activeListener is a listener being served
+type activeListener struct {
+	config     config.ListenerConfig
+	ln         net.Listener
+	srv        *http.Server
+	fromConfig bool
+}
+
+type listenerNameKey struct{}
+
+// listenerName returns the name of the listener that accepted the request
+func listenerName(ctx context.Context) string {
+	name, _ := ctx.Value(listenerNameKey{}).(string)
+	return name
+}
+
+// listenSettings listens to settings changes from the config, like listeners and certificates
+func (s *Server) listenSettings(settings <-chan *config.Settings) {
+	for settings := range settings {
+		s.updateCertificates(settings.Certificates)
+		s.listenersMtx.Lock()
+		s.settings = settings
+		if s.serving {
+			s.updateListeners()
+		}
+		s.listenersMtx.Unlock()
+	}
+}
+
+// updateListeners starts and stops listeners to match the ones in the config.
+// It has to be called with listenersMtx locked.
+func (s *Server) updateListeners() {
+	desired := make(map[string]config.ListenerConfig)
+	if s.settings != nil {
+		for _, l := range s.settings.Listeners {
+			desired[l.Name] = l
+		}
+	}
+	for name, active := range s.listeners {
+		if l, ok := desired[name]; active.fromConfig && (!ok || l != active.config) {
+			s.stopListener(active)
+		}
+	}
+	if s.settings == nil {
+		return
+	}
+	for _, l := range s.settings.Listeners {
+		if active, ok := s.listeners[l.Name]; ok {
+			if !active.fromConfig {
+				log.Printf("Listener %s ignored: name is already used by a command line listener", l)
+			}
+			continue
+		}
+		if err := s.startListener(l, false); err != nil {
+			log.Printf("Listener %s failed: %v", l, err)
+		}
+	}
+}
+
+// startListener starts serving on a new listener.
+// If fatal is set, the error of the listener is returned by Serve.
+func (s *Server) startListener(l config.ListenerConfig, fatal bool) error {
+	if l.Protocol == "https" && s.config.NoCert {
+		log.Printf("Listener %s ignored: HTTPS is disabled", l)
+		return nil
+	}
+	ln, err := listener.Listen(l.Name, l.Addr)
+	if err != nil {
+		return err
+	}
+	srv := s.newHTTPServer(l)
+	s.listeners[l.Name] = &activeListener{
+		config:     l,
+		ln:         ln,
+		srv:        srv,
+		fromConfig: !fatal,
+	}
+	log.Println("Listening on", l)
+
+	go func() {
+		err := s.serve(srv, ln, l.Name, l.Protocol == "https")
+		if fatal {
+			s.errChan <- err
+		} else if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Listener %s: %v", l, err)
+		}
+	}()
+	return nil
+}
+
+// stopListener closes a listener and drains its connections in the background
+func (s *Server) stopListener(active *activeListener) {
+	log.Println("Closing listener", active.config)
+	delete(s.listeners, active.config.Name)
+	listener.Release(active.config.Name)
+	active.ln.Close()
+
+	s.serversMtx.Lock()
+	delete(s.servers, active.srv)
+	s.serversMtx.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.DrainTimeout)
+		defer cancel()
+		if err := active.srv.Shutdown(ctx); err != nil {
+			active.srv.Close()
+		}
+	}()
+}
+
+func (s *Server) newHTTPServer(l config.ListenerConfig) *http.Server {
+	var handler http.Handler = s
+	if l.Protocol == "http" && !s.config.NoCert {
+		// serve ACME challenges, then either redirect to HTTPS or serve the routes
+		var fallback http.Handler
+		if !l.Redirect {
+			fallback = s
+		}
+		handler = s.certManager.HTTPHandler(fallback)
+	}
+	srv := &http.Server{
+		Handler:           logger.LoggerMiddleware(handler),
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		ReadTimeout:       s.config.ReadTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+		MaxHeaderBytes:    s.config.MaxHeaderBytes,
+	}
+	if l.Protocol == "https" {
+		tlsConfig := &tls.Config{
+			GetCertificate: s.getCertificate,
+			NextProtos:     []string{"h2", "http/1.1"}, // set here, since configs for mtls hosts are cloned from this one
+		}
+		if !s.config.EnableHTTP2 {
+			srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.tlsConfigForClient(tlsConfig, hello)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	return srv
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"sync"
+
+	"github.com/razzie/razvhost/pkg/mux"
+	"golang.org/x/crypto/acme"
+)
+
+// mtlsHost is the client certificate request of the TLS handshake for a route hostname
+type mtlsHost struct {
+	clientCAs *x509.CertPool // CA bundles of all mtls routes of the hostname
+	required  bool           // every route of the hostname requires a client certificate
+	configs   sync.Map       // TLS configs by listener config
+}
+
+// newMTLSHosts collects the mtls settings of the routes by hostname. Routes of the same hostname with different paths
+// share the handshake, so the certificate is only required there if every route requires it,
+// and the routes themselves reject requests without a valid certificate.
+func newMTLSHosts(order []string, routes map[string]*route) map[string]*mtlsHost {
+	hosts := make(map[string]*mtlsHost)
+	optional := make(map[string]bool)
+	for _, id := range order {
+		r := routes[id]
+		host, _ := mux.SplitRoute(r.entry.Hostname)
+		if r.mtls == nil || !r.mtls.Required {
+			optional[host] = true
+		}
+		if r.mtls == nil {
+			continue
+		}
+		h := hosts[host]
+		if h == nil {
+			h = &mtlsHost{clientCAs: x509.NewCertPool()}
+			hosts[host] = h
+		}
+		for _, ca := range r.mtls.CAs {
+			h.clientCAs.AddCert(ca)
+		}
+	}
+	for host, h := range hosts {
+		h.required = !optional[host]
+	}
+	return hosts
+}
+
+// tlsConfigForClient implements tls.Config.GetConfigForClient. If the route serving the SNI name has mtls options,
+// the handshake requests a client certificate, otherwise the listener's config is used.
+func (s *Server) tlsConfigForClient(base *tls.Config, hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return nil, nil
+		}
+	}
+	table := s.routes.Load()
+	pattern, ok := table.mux.HostPattern(strings.ToLower(strings.TrimSuffix(hello.ServerName, ".")))
+	if !ok {
+		return nil, nil
+	}
+	host := table.mtls[pattern]
+	if host == nil {
+		return nil, nil
+	}
+	return host.tlsConfig(base), nil
+}
+
+// tlsConfig returns the listener's TLS config with the client certificate request of the hostname
+func (h *mtlsHost) tlsConfig(base *tls.Config) *tls.Config {
+	if cfg, ok := h.configs.Load(base); ok {
+		return cfg.(*tls.Config)
+	}
+	cfg := base.Clone()
+	cfg.GetConfigForClient = nil
+	cfg.ClientCAs = h.clientCAs
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if h.required {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	actual, _ := h.configs.LoadOrStore(base, cfg)
+	return actual.(*tls.Config)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/handler"
+	"github.com/razzie/razvhost/pkg/mux"
+)
+
+// routeSet is the desired set of config entries, updated by every config event
+// even if the routing table cannot be built from it yet
+type routeSet struct {
+	order   []string
+	entries map[string]config.ConfigEntry
+}
+
+func newRouteSet() *routeSet {
+	return &routeSet{
+		entries: make(map[string]config.ConfigEntry),
+	}
+}
+
+func (rs *routeSet) apply(events []config.ConfigEvent) {
+	for _, e := range events {
+		id := e.ID()
+		if !e.Up {
+			delete(rs.entries, id)
+			continue
+		}
+		if _, ok := rs.entries[id]; !ok {
+			rs.entries[id] = e.ConfigEntry
+			rs.order = append(rs.order, id)
+		}
+	}
+	order := rs.order[:0]
+	added := make(map[string]bool, len(rs.entries))
+	for _, id := range rs.order {
+		if _, ok := rs.entries[id]; ok && !added[id] {
+			added[id] = true
+			order = append(order, id)
+		}
+	}
+	rs.order = order
+}
+
+// routingTable is a complete set of routes. It is never modified after being built,
+// config changes produce a new table that replaces the previous one atomically.
+// Routes restricted to listeners by the listeners option are only in the muxes of those listeners.
+type routingTable struct {
+	mux        mux.Mux // all routes
+	public     mux.Mux // routes without listener restriction
+	restricted map[string]*mux.Mux
+	certAllow  map[string][]string  // cert.allow patterns by route hostname
+	mtls       map[string]*mtlsHost // client certificate settings by route hostname
+	order      []string
+	routes     map[string]*route
+}
+
+type route struct {
+	entry   config.ConfigEntry
+	backend mux.Backend
+	mtls    *config.MTLSConfig
+}
+
+// close stops the background activity of the handler, like health checks
+func (r *route) close() {
+	if closer, ok := r.backend.Handler.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func newRoutingTable() *routingTable {
+	return &routingTable{
+		routes: make(map[string]*route),
+	}
+}
+
+// build returns a new routing table for the route set, reusing the handlers of unchanged routes.
+// If any route fails to build, no table is returned and the handlers created for it are closed.
+func (t *routingTable) build(rs *routeSet, factory *handler.HandlerFactory) (*routingTable, error) {
+	table := &routingTable{
+		order:  append([]string(nil), rs.order...),
+		routes: make(map[string]*route, len(rs.entries)),
+	}
+	var errs []error
+	var created []*route
+	for _, id := range rs.order {
+		if r, ok := t.routes[id]; ok {
+			table.routes[id] = r
+			continue
+		}
+		entry := rs.entries[id]
+		r, err := newRoute(entry, factory)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.String(), err))
+			continue
+		}
+		table.routes[id] = r
+		created = append(created, r)
+	}
+	if len(errs) > 0 {
+		for _, r := range created {
+			r.close()
+		}
+		return nil, errors.Join(errs...)
+	}
+	table.restricted = make(map[string]*mux.Mux)
+	for _, id := range table.order {
+		for _, name := range table.routes[id].entry.Options.List("listeners") {
+			table.restricted[name] = new(mux.Mux)
+		}
+	}
+	table.certAllow = make(map[string][]string)
+	for _, id := range table.order {
+		r := table.routes[id]
+		table.mux.AddBackend(r.entry.Hostname, r.backend)
+		if allow, _ := r.entry.CertAllow(); len(allow) > 0 {
+			host, _ := mux.SplitRoute(r.entry.Hostname)
+			table.certAllow[host] = append(table.certAllow[host], allow...)
+		}
+		listeners := r.entry.Options.List("listeners")
+		if len(listeners) == 0 {
+			table.public.AddBackend(r.entry.Hostname, r.backend)
+			for _, m := range table.restricted {
+				m.AddBackend(r.entry.Hostname, r.backend)
+			}
+			continue
+		}
+		for _, name := range listeners {
+			table.restricted[name].AddBackend(r.entry.Hostname, r.backend)
+		}
+	}
+	table.mtls = newMTLSHosts(table.order, table.routes)
+	return table, nil
+}
+
+// newRoute checks the options of a config entry and builds its handler
+func newRoute(entry config.ConfigEntry, factory *handler.HandlerFactory) (*route, error) {
+	backend, err := entry.Backend()
+	if err != nil {
+		return nil, err
+	}
+	if err = entry.CheckTemplate(); err != nil {
+		return nil, err
+	}
+	if _, err = entry.CertAllow(); err != nil {
+		return nil, err
+	}
+	mtls, err := config.NewMTLSConfig(entry.Options)
+	if err != nil {
+		return nil, err
+	}
+	if backend.Handler, err = factory.Handler(entry.Hostname, entry.Target, entry.Options); err != nil {
+		return nil, err
+	}
+	backend.State = new(mux.BackendState) // kept while the route is unchanged, so load balancing state survives reloads
+	return &route{entry: entry, backend: backend, mtls: mtls}, nil
+}
+
+// listenerMux returns the routes served on the named listener
+func (t *routingTable) listenerMux(name string) *mux.Mux {
+	if m, ok := t.restricted[name]; ok {
+		return m
+	}
+	return &t.public
+}
+
+// closeRemoved closes the handlers of the routes that are not part of the other table
+func (t *routingTable) closeRemoved(other *routingTable) {
+	for id, r := range t.routes {
+		if _, ok := other.routes[id]; !ok {
+			r.close()
+		}
+	}
+}
+
+// diff returns the routes added and removed by the other table
+func (t *routingTable) diff(other *routingTable) (up, down []config.ConfigEntry) {
+	for _, id := range other.order {
+		if _, ok := t.routes[id]; !ok {
+			up = append(up, other.routes[id].entry)
+		}
+	}
+	for _, id := range t.order {
+		if _, ok := other.routes[id]; !ok {
+			down = append(down, t.routes[id].entry)
+		}
+	}
+	return
+}
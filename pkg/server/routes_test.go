@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/razzie/razvhost/pkg/config"
+	"github.com/razzie/razvhost/pkg/handler"
+)
+
+func newTestRouteServer() *Server {
+	s := &Server{
+		routeSet: newRouteSet(),
+		factory:  handler.NewHandlerFactory(nil, handler.UpstreamConfig{}),
+	}
+	s.routes.Store(newRoutingTable())
+	return s
+}
+
+func testEvent(t *testing.T, hostname, target string, up bool) config.ConfigEvent {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.ConfigEvent{ConfigEntry: config.ConfigEntry{Hostname: hostname, Target: *u}, Up: up}
+}
+
+func routeIDs(s *Server) []string {
+	return append([]string(nil), s.routes.Load().order...)
+}
+
+func TestReloadKeepsTableOnError(t *testing.T) {
+	s := newTestRouteServer()
+
+	// nothing is applied from a first config with a broken line
+	s.ProcessEvents([]config.ConfigEvent{
+		testEvent(t, "a.example.com", "redirect://a.example.org", true),
+		testEvent(t, "b.example.com", "unknown://b", true),
+	})
+	if ids := routeIDs(s); len(ids) > 0 {
+		t.Errorf("routes applied from a broken config: %v", ids)
+	}
+	if status := s.Status(); status.LastFailure == nil || status.LastReload.Success {
+		t.Errorf("failed reload not reported: %+v", status)
+	}
+
+	// fixing the line applies the whole config
+	s.ProcessEvents([]config.ConfigEvent{
+		testEvent(t, "b.example.com", "unknown://b", false),
+		testEvent(t, "b.example.com", "redirect://b.example.org", true),
+	})
+	want := []string{"a.example.com -> redirect://a.example.org ", "b.example.com -> redirect://b.example.org "}
+	if ids := routeIDs(s); len(ids) != 2 || ids[0] != want[0] || ids[1] != want[1] {
+		t.Errorf("routes %q, want %q", ids, want)
+	}
+	if status := s.Status(); !status.LastReload.Success || status.Routes != 2 {
+		t.Errorf("reload status: %+v", status.LastReload)
+	}
+
+	// a change with a broken line leaves the previous table in place, including the other hostnames
+	prev := s.routes.Load()
+	s.ProcessEvents([]config.ConfigEvent{
+		testEvent(t, "a.example.com", "redirect://a.example.org", false),
+		testEvent(t, "a.example.com", "redirect://a2.example.org", true),
+		testEvent(t, "b.example.com", "redirect://b.example.org", false),
+		testEvent(t, "b.example.com", "unknown://b", true),
+	})
+	if s.routes.Load() != prev {
+		t.Errorf("routes %q applied from a broken config, want %q", routeIDs(s), want)
+	}
+	if status := s.Status(); status.LastReload.Success || status.LastFailure != status.LastReload || status.Routes != 2 {
+		t.Errorf("reload status: %+v", status.LastReload)
+	}
+}
+
+func TestReloadKeepsEjection(t *testing.T) {
+	var failed atomic.Int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+
+	s := newTestRouteServer()
+	s.ProcessEvents([]config.ConfigEvent{
+		testEvent(t, "a.example.com", bad.URL, true),
+		testEvent(t, "a.example.com", good.URL, true),
+	})
+	get := func() {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "http://a.example.com/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d, want the response of the healthy target", w.Code)
+		}
+	}
+	get()
+	get()
+	if failed.Load() != 1 {
+		t.Fatalf("failing target got %d requests, want 1", failed.Load())
+	}
+
+	// an unrelated change rebuilds the table, but the failing target stays ejected
+	s.ProcessEvents([]config.ConfigEvent{testEvent(t, "b.example.com", "redirect://b.example.org", true)})
+	for i := 0; i < 10; i++ {
+		get()
+	}
+	if failed.Load() != 1 {
+		t.Errorf("ejected target got %d requests after a reload", failed.Load()-1)
+	}
+}
+
+func TestReloadKeepsInflightRequests(t *testing.T) {
+	arrived := make(chan string)
+	release := make(chan struct{})
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+			if r.Header.Get("X-Hold") != "" {
+				arrived <- name
+				<-release
+			}
+		}))
+	}
+	a, b := newBackend("a"), newBackend("b")
+	defer a.Close()
+	defer b.Close()
+
+	s := newTestRouteServer()
+	var events []config.ConfigEvent
+	for _, backend := range []*httptest.Server{a, b} {
+		e := testEvent(t, "lb.example.com", backend.URL, true)
+		e.Options = config.Options{"lb": "least-conn"}
+		events = append(events, e)
+	}
+	s.ProcessEvents(events)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := httptest.NewRequest("GET", "http://lb.example.com/", nil)
+		r.Header.Set("X-Hold", "1")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	busy := <-arrived
+
+	// the table is rebuilt while the request is in flight, least-conn still avoids the busy target
+	s.ProcessEvents([]config.ConfigEvent{testEvent(t, "other.example.com", "redirect://other.example.org", true)})
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "http://lb.example.com/", nil))
+		if backend := w.Header().Get("X-Backend"); backend == busy {
+			t.Errorf("request %d served by the busy target %s", i, busy)
+		}
+	}
+	close(release)
+	<-done
+}
@@ -2,15 +2,18 @@ package server
 
 import (
 	"context"
-	"crypto/tls"
-	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/razzie/razvhost/pkg/config"
 	"github.com/razzie/razvhost/pkg/handler"
+	"github.com/razzie/razvhost/pkg/listener"
 	"github.com/razzie/razvhost/pkg/logger"
 	"github.com/razzie/razvhost/pkg/mux"
 	"github.com/razzie/razvhost/pkg/stream"
@@ -18,6 +21,7 @@ import (
 )
 
 type ServerConfig struct {
+	Listeners         []config.ListenerConfig
 	ConfigFile        string
 	CertsDir          string
 	NoCert            bool
@@ -26,36 +30,65 @@ type ServerConfig struct {
 	DiscardHeaders    []string
 	ExtraHeaders      map[string]string
 	PHPAddr           string
+	DrainTimeout      time.Duration
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	Upstream          handler.UpstreamConfig
+	StickySecret      string
+	WildcardCertRate  int
+	AdminToken        string
+	ACME              ACMEConfig
 }
 
 type Server struct {
-	mux            mux.Mux
-	config         ServerConfig
-	internalServer *http.Server
-	certManager    *autocert.Manager
-	factory        *handler.HandlerFactory
+	routes        atomic.Pointer[routingTable]
+	routeSet      *routeSet
+	reloadMtx     sync.Mutex
+	lastReload    *ReloadStatus
+	lastFailure   *ReloadStatus
+	config        ServerConfig
+	listeners     map[string]*activeListener
+	listenersMtx  sync.Mutex
+	settings      *config.Settings
+	serving       bool
+	errChan       chan error
+	servers       map[*http.Server]bool
+	serversMtx    sync.Mutex
+	shuttingDown  bool
+	conns         *connTracker
+	baseCtx       context.Context
+	cancelBaseCtx context.CancelFunc
+	certManager   *autocert.Manager
+	certRate      *certRateLimiter
+	acmeAccount   *acmeAccount
+	acmeReplaced  sync.Map // certificates replaced by renewing or revoking, by the SHA-256 of their leaf
+	acmeRenewMtx  sync.Mutex
+	wildcardCerts *wildcardIssuer
+	staticCerts   atomic.Pointer[certStore]
+	configWatch   *config.Config
+	dockerWatch   *config.DockerWatch
+	factory       *handler.HandlerFactory
 }
 
 func NewServer(cfg ServerConfig) *Server {
 	s := &Server{
-		config: cfg,
+		config:    cfg,
+		routeSet:  newRouteSet(),
+		listeners: make(map[string]*activeListener),
+		errChan:   make(chan error, len(cfg.Listeners)),
+		servers:   make(map[*http.Server]bool),
+		conns:     newConnTracker(),
+		certRate:  newCertRateLimiter(cfg.WildcardCertRate),
 	}
+	s.baseCtx, s.cancelBaseCtx = context.WithCancel(context.Background())
+	s.routes.Store(newRoutingTable())
 
-	// set up internal server
-	s.certManager = &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		Cache:      autocert.DirCache(s.config.CertsDir),
-		HostPolicy: s.ValidateHost,
-	}
-	s.internalServer = &http.Server{
-		Addr:    ":443",
-		Handler: logger.LoggerMiddleware(s),
-		TLSConfig: &tls.Config{
-			GetCertificate: s.certManager.GetCertificate,
-		},
-	}
-	if !cfg.EnableHTTP2 {
-		s.internalServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	s.initCertManagers()
+	if len(cfg.StickySecret) > 0 {
+		mux.SetStickySecret([]byte(cfg.StickySecret))
 	}
 
 	// set up handler factory
@@ -63,7 +96,7 @@ func NewServer(cfg ServerConfig) *Server {
 	if err != nil {
 		log.Println(err)
 	}
-	s.factory = handler.NewHandlerFactory(phpaddr)
+	s.factory = handler.NewHandlerFactory(phpaddr, cfg.Upstream)
 
 	// get config
 	if len(cfg.ConfigFile) > 0 {
@@ -76,6 +109,9 @@ func NewServer(cfg ServerConfig) *Server {
 			log.Println(err)
 		}
 	}
+	if !cfg.NoCert {
+		go s.watchCertificates()
+	}
 
 	return s
 }
@@ -87,43 +123,76 @@ func (s *Server) Listen(events <-chan []config.ConfigEvent) {
 	}
 }
 
-// ProcessEvents processes a list of config events
+// ProcessEvents applies a list of config events to the routing table.
+// A complete new table is built and swapped in atomically. If any route fails to build,
+// the previous table is kept and the changes are retried with the next config events.
 func (s *Server) ProcessEvents(events []config.ConfigEvent) {
-	for _, e := range events {
-		s.ProcessEvent(e)
-	}
-}
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
 
-// ProcessEvent processes a single config event
-func (s *Server) ProcessEvent(e config.ConfigEvent) {
-	log.Println("CONFIG:", e.String())
-
-	if !e.Up {
-		s.mux.Remove(e.Hostname, e.Target.String())
+	s.routeSet.apply(events)
+	prev := s.routes.Load()
+	status := &ReloadStatus{Time: time.Now()}
+	table, err := prev.build(s.routeSet, s.factory)
+	if err != nil {
+		log.Println("CONFIG: reload failed, keeping previous routes:", err)
+		status.Error = err.Error()
+		status.Routes = len(prev.routes)
+		s.lastReload = status
+		s.lastFailure = status
 		return
 	}
 
-	handler, err := s.factory.Handler(e.Hostname, e.Target)
-	if err != nil {
-		log.Println(err)
-		e.Up = false
-		log.Println("CONFIG:", e.String())
-		return
+	s.routes.Store(table)
+	prev.closeRemoved(table)
+	up, down := prev.diff(table)
+	for _, e := range up {
+		log.Println("CONFIG:", config.ConfigEvent{ConfigEntry: e, Up: true}.String())
+		status.Up = append(status.Up, e.String())
+	}
+	for _, e := range down {
+		log.Println("CONFIG:", config.ConfigEvent{ConfigEntry: e, Up: false}.String())
+		status.Down = append(status.Down, e.String())
+	}
+	if len(up) > 0 || len(down) > 0 {
+		log.Printf("CONFIG: reload applied: %d up, %d down, %d routes total", len(up), len(down), len(table.routes))
 	}
+	status.Success = true
+	status.Routes = len(table.routes)
+	s.lastReload = status
+}
 
-	s.mux.Add(e.Hostname, handler, e.Target.String())
+// ProcessEvent processes a single config event
+func (s *Server) ProcessEvent(e config.ConfigEvent) {
+	s.ProcessEvents([]config.ConfigEvent{e})
 }
 
-// ValidateHost implements autocert.HostPolicy
-func (s *Server) ValidateHost(ctx context.Context, host string) error {
-	if !s.mux.ContainsHost(host) {
-		return fmt.Errorf("unknown hostname: %s", host)
+// Reload re-reads the config, rescans Docker containers and reloads wildcard certificates from disk.
+// The ACME certificate manager is kept, so its renewal timers are not duplicated.
+func (s *Server) Reload() {
+	log.Println("Reloading")
+	if s.configWatch != nil {
+		s.configWatch.Reload()
+	}
+	if s.dockerWatch != nil {
+		events, err := s.dockerWatch.Rescan()
+		if err != nil {
+			log.Println("Docker rescan failed:", err)
+		} else if len(events) > 0 {
+			s.ProcessEvents(events)
+		}
+	}
+	if s.wildcardCerts != nil {
+		s.wildcardCerts.reload()
 	}
-	return nil
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if handler := s.mux.Handler(r.Host + r.URL.Path); handler != nil {
+	s.serveMux(w, r, s.routes.Load().listenerMux(listenerName(r.Context())))
+}
+
+func (s *Server) serveMux(w http.ResponseWriter, r *http.Request, m *mux.Mux) {
+	if handler := m.Handler(r); handler != nil {
 		s.updateHeaders(w, r)
 		handler.ServeHTTP(w, r)
 		return
@@ -131,28 +200,108 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Cannot serve path: "+r.Host+r.URL.Path, http.StatusForbidden)
 }
 
+// Serve starts the command line and config listeners, or takes over the inherited ones,
+// then tells the parent process to shut down in case of an upgrade.
+// It returns when one of the command line listeners fails.
 func (s *Server) Serve() error {
-	if s.config.NoCert {
-		s.internalServer.Addr = ":80"
-		return s.internalServer.ListenAndServe()
+	s.listenersMtx.Lock()
+	for _, l := range s.config.Listeners {
+		if err := s.startListener(l, true); err != nil {
+			s.listenersMtx.Unlock()
+			return err
+		}
 	}
+	s.serving = true
+	s.updateListeners()
+	s.listenersMtx.Unlock()
 
-	errChan := make(chan error, 1)
-	go func() {
-		acmeHandler := s.certManager.HTTPHandler(nil)
-		errChan <- http.ListenAndServe(":80", logger.LoggerMiddleware(acmeHandler))
-	}()
-	go func() {
-		errChan <- s.internalServer.ListenAndServeTLS("", "")
-	}()
-	return <-errChan
+	listener.Ready()
+	return <-s.errChan
 }
 
+// serve serves srv on ln and makes it part of the graceful shutdown
+func (s *Server) serve(srv *http.Server, ln net.Listener, name string, useTLS bool) error {
+	ctx := context.WithValue(s.baseCtx, listenerNameKey{}, name)
+	srv.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+
+	s.serversMtx.Lock()
+	if s.shuttingDown {
+		s.serversMtx.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	s.servers[srv] = true
+	s.serversMtx.Unlock()
+
+	ln = s.conns.listener(ln)
+	if useTLS {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// Shutdown stops accepting new connections on all listeners and waits for in-flight requests,
+// including hijacked connections like websockets. Connections still open after the drain timeout are closed.
 func (s *Server) Shutdown() error {
-	return s.internalServer.Shutdown(context.Background())
+	s.serversMtx.Lock()
+	servers := s.servers
+	s.servers = make(map[*http.Server]bool)
+	s.shuttingDown = true
+	s.serversMtx.Unlock()
+
+	log.Printf("Shutdown: closing %d listeners, draining %d connections (timeout: %v)",
+		len(servers), s.conns.count(), s.config.DrainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.DrainTimeout)
+	defer cancel()
+
+	errChan := make(chan error, len(servers))
+	for srv := range servers {
+		go func(srv *http.Server) {
+			errChan <- srv.Shutdown(ctx)
+		}(srv)
+	}
+
+	// http.Server.Shutdown doesn't wait for hijacked connections, so wait for the tracker as well
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+drain:
+	for s.conns.count() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("Shutdown: drain timeout exceeded, closing %d connections", s.conns.count())
+			s.cancelBaseCtx()
+			for srv := range servers {
+				srv.Close()
+			}
+			s.conns.closeAll()
+			break drain
+		case <-progress.C:
+			log.Printf("Shutdown: waiting for %d connections", s.conns.count())
+		case <-poll.C:
+		}
+	}
+	s.cancelBaseCtx()
+
+	var err error
+	for range servers {
+		if srvErr := <-errChan; srvErr != nil && srvErr != context.DeadlineExceeded {
+			err = srvErr
+		}
+	}
+	log.Println("Shutdown: done")
+	return err
 }
 
 func (s *Server) Debug(addr string) error {
+	ln, err := listener.Listen("debug", addr)
+	if err != nil {
+		return err
+	}
 	log.Println("Debug interface listening on", addr)
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uri := strings.SplitN(r.URL.Path, "/", 3)
@@ -165,9 +314,9 @@ func (s *Server) Debug(addr string) error {
 		r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, "/"+r.Host)
 		ww := stream.NewPathPrefixHTMLResponseWriter(r.URL.Host, "/"+r.Host, "", w)
 		defer ww.Close()
-		s.ServeHTTP(ww, r)
+		s.serveMux(ww, r, &s.routes.Load().mux)
 	})
-	return http.ListenAndServe(addr, logger.LoggerMiddleware(handler))
+	return s.serve(&http.Server{Handler: logger.LoggerMiddleware(handler)}, ln, "debug", false)
 }
 
 func (s *Server) updateHeaders(w http.ResponseWriter, r *http.Request) {
@@ -191,7 +340,9 @@ func (s *Server) loadConfig() error {
 	if err != nil {
 		return err
 	}
+	s.configWatch = cfg
 	go s.Listen(cfg.C)
+	go s.listenSettings(cfg.S)
 
 	return nil
 }
@@ -201,6 +352,7 @@ func (s *Server) watchDockerEvents() error {
 	if err != nil {
 		return err
 	}
+	s.dockerWatch = docker
 
 	events, err := docker.GetActiveContainers()
 	if err != nil {
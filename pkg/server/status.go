@@ -0,0 +1,55 @@
+package server
+
+import (
+	"time"
+
+	"github.com/razzie/razvhost/pkg/handler"
+)
+
+// ReloadStatus describes the result of a routing table update
+type ReloadStatus struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	Up      []string  `json:"up,omitempty"`
+	Down    []string  `json:"down,omitempty"`
+	Routes  int       `json:"routes"`
+}
+
+// Status contains the current state of the server
+type Status struct {
+	Routes      int           `json:"routes"`
+	LastReload  *ReloadStatus `json:"last_reload,omitempty"`
+	LastFailure *ReloadStatus `json:"last_failure,omitempty"`
+}
+
+// Status returns the current state of the server, including the last failed reload
+func (s *Server) Status() Status {
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
+
+	return Status{
+		Routes:      len(s.routes.Load().routes),
+		LastReload:  s.lastReload,
+		LastFailure: s.lastFailure,
+	}
+}
+
+// RouteStats contains the runtime statistics of a route target
+type RouteStats struct {
+	Route string `json:"route"`
+	handler.TargetStats
+}
+
+// Stats returns the runtime statistics of every route target
+func (s *Server) Stats() []RouteStats {
+	table := s.routes.Load()
+	stats := make([]RouteStats, 0, len(table.order))
+	for _, id := range table.order {
+		r := table.routes[id]
+		if targetStats, ok := handler.StatsOf(r.backend.Handler); ok {
+			stats = append(stats, RouteStats{Route: r.entry.String(), TargetStats: targetStats})
+		}
+	}
+	return stats
+}
@@ -0,0 +1,563 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA is a minimal ACME CA for tests. Challenges are validated in process: http-01 through httpHandler,
+// tls-alpn-01 with a TLS handshake through getCertificate and dns-01 through lookupTXT.
+// New accounts need an External Account Binding if eabKID is set. JWS signatures of the account keys are not verified.
+type testCA struct {
+	t              *testing.T
+	server         *httptest.Server
+	key            *ecdsa.PrivateKey
+	root           *x509.Certificate
+	challengeTypes []string
+	httpHandler    http.Handler
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	lookupTXT      func(name string) []string
+	eabKID         string
+	eabKey         []byte
+
+	mtx      sync.Mutex
+	nonce    int
+	accounts map[string]string // JWK thumbprints by account URL
+	orders   []*testOrder
+	authzs   []*testAuthz
+	issued   []*x509.Certificate
+	revoked  []*x509.Certificate
+}
+
+type testOrder struct {
+	identifiers []string
+	authzs      []int
+	cert        []byte // DER of the issued certificate
+}
+
+type testAuthz struct {
+	domain     string
+	wildcard   bool
+	token      string
+	thumbprint string
+	status     string
+	validated  string // type of the challenge that validated the authorization
+}
+
+func newTestCA(t *testing.T, challengeTypes ...string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "razvhost test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{
+		t:              t,
+		key:            key,
+		challengeTypes: challengeTypes,
+		accounts:       make(map[string]string),
+	}
+	if ca.root, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.server = httptest.NewTLSServer(http.HandlerFunc(ca.handle))
+	t.Cleanup(ca.server.Close)
+	return ca
+}
+
+// acmeConfig returns the config of an ACME client using the CA, given the same way as on the command line
+func (ca *testCA) acmeConfig(t *testing.T, keyType string) ACMEConfig {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var eabHMAC string
+	if len(ca.eabKey) > 0 {
+		eabHMAC = base64.RawURLEncoding.EncodeToString(ca.eabKey)
+	}
+	cfg, err := NewACMEConfig(ca.server.URL+"/directory", "admin@example.com", ca.eabKID, eabHMAC, keyType, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// serve validates the challenges through the ACME handlers of s
+func (ca *testCA) serve(s *Server) {
+	ca.httpHandler = s.certManager.HTTPHandler(nil)
+	ca.getCertificate = s.getCertificate
+}
+
+// rootPool returns the root of the issued certificates
+func (ca *testCA) rootPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.root)
+	return pool
+}
+
+func (ca *testCA) issuedCount() int {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+	return len(ca.issued)
+}
+
+func (ca *testCA) isRevoked(cert *x509.Certificate) bool {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+	return slices.ContainsFunc(ca.revoked, cert.Equal)
+}
+
+func (ca *testCA) url(format string, args ...any) string {
+	return ca.server.URL + fmt.Sprintf(format, args...)
+}
+
+func (ca *testCA) handle(w http.ResponseWriter, r *http.Request) {
+	ca.mtx.Lock()
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", "nonce"+strconv.Itoa(ca.nonce))
+	ca.mtx.Unlock()
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch path[0] {
+	case "directory":
+		writeJSON(w, map[string]any{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+			"revokeCert": ca.url("/revoke"),
+			"meta":       map[string]any{"externalAccountRequired": len(ca.eabKID) > 0},
+		})
+	case "nonce":
+	default:
+		jws, err := readTestJWS(r)
+		if err != nil {
+			writeACMEError(w, http.StatusBadRequest, "malformed", err.Error())
+			return
+		}
+		ca.mtx.Lock()
+		defer ca.mtx.Unlock()
+		ca.handlePost(w, path, jws)
+	}
+}
+
+func (ca *testCA) handlePost(w http.ResponseWriter, path []string, jws *testJWS) {
+	account := jws.KID
+	if path[0] != "account" && path[0] != "revoke" {
+		if _, ok := ca.accounts[account]; !ok {
+			writeACMEError(w, http.StatusUnauthorized, "accountDoesNotExist", "unknown account: "+account)
+			return
+		}
+	}
+	id := -1
+	if len(path) > 1 {
+		id, _ = strconv.Atoi(path[1])
+	}
+	switch {
+	case path[0] == "account":
+		thumbprint, err := jwkThumbprint(jws.JWK)
+		if err != nil {
+			writeACMEError(w, http.StatusBadRequest, "malformed", err.Error())
+			return
+		}
+		for url, t := range ca.accounts {
+			if t == thumbprint {
+				w.Header().Set("Location", url)
+				writeJSON(w, map[string]any{"status": "valid"})
+				return
+			}
+		}
+		if err := ca.checkEAB(jws); err != nil {
+			writeACMEError(w, http.StatusUnauthorized, "externalAccountRequired", err.Error())
+			return
+		}
+		url := ca.url("/account/%d", len(ca.accounts))
+		ca.accounts[url] = thumbprint
+		w.Header().Set("Location", url)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]any{"status": "valid"})
+
+	case path[0] == "order" && id < 0:
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		if err := json.Unmarshal(jws.Payload, &req); err != nil {
+			writeACMEError(w, http.StatusBadRequest, "malformed", err.Error())
+			return
+		}
+		o := &testOrder{}
+		for _, ident := range req.Identifiers {
+			domain, wildcard := strings.CutPrefix(ident.Value, "*.")
+			o.identifiers = append(o.identifiers, ident.Value)
+			o.authzs = append(o.authzs, len(ca.authzs))
+			ca.authzs = append(ca.authzs, &testAuthz{
+				domain:     domain,
+				wildcard:   wildcard,
+				token:      fmt.Sprintf("token%d", len(ca.authzs)),
+				thumbprint: ca.accounts[account],
+				status:     "pending",
+			})
+		}
+		ca.orders = append(ca.orders, o)
+		w.Header().Set("Location", ca.url("/order/%d", len(ca.orders)-1))
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, ca.orderJSON(len(ca.orders)-1))
+
+	case path[0] == "order" && id < len(ca.orders):
+		writeJSON(w, ca.orderJSON(id))
+
+	case path[0] == "authz" && id >= 0 && id < len(ca.authzs):
+		writeJSON(w, ca.authzJSON(id))
+
+	case path[0] == "challenge" && id >= 0 && id < len(ca.authzs) && len(path) == 3:
+		a := ca.authzs[id]
+		if a.status == "pending" {
+			ca.mtx.Unlock() // the challenge is validated through the server, which may call the CA
+			err := ca.validate(a, path[2])
+			ca.mtx.Lock()
+			a.status, a.validated = "valid", path[2]
+			if err != nil {
+				ca.t.Logf("%s challenge of %s failed: %v", path[2], a.domain, err)
+				a.status = "invalid"
+			}
+		}
+		writeJSON(w, map[string]any{"type": path[2], "url": ca.url("/challenge/%d/%s", id, path[2]), "token": a.token,
+			"status": a.status})
+
+	case path[0] == "finalize" && id >= 0 && id < len(ca.orders):
+		if status := ca.orderJSON(id)["status"]; status != "ready" {
+			writeACMEError(w, http.StatusForbidden, "orderNotReady", fmt.Sprint("order is ", status))
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(jws.Payload, &req)
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err == nil {
+			der, err = ca.issue(ca.orders[id], der)
+		}
+		if err != nil {
+			writeACMEError(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		ca.orders[id].cert = der
+		writeJSON(w, ca.orderJSON(id))
+
+	case path[0] == "cert" && id >= 0 && id < len(ca.orders) && ca.orders[id].cert != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.orders[id].cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})
+
+	case path[0] == "revoke":
+		var req struct{ Certificate string }
+		json.Unmarshal(jws.Payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.Certificate)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil || cert.CheckSignatureFrom(ca.root) != nil {
+			writeACMEError(w, http.StatusNotFound, "malformed", "unknown certificate")
+			return
+		}
+		ca.revoked = append(ca.revoked, cert)
+
+	default:
+		writeACMEError(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+// checkEAB verifies the External Account Binding of a new account request if the CA requires one
+func (ca *testCA) checkEAB(jws *testJWS) error {
+	if len(ca.eabKID) == 0 {
+		return nil
+	}
+	var req struct {
+		ExternalAccountBinding *struct{ Protected, Payload, Signature string }
+	}
+	if err := json.Unmarshal(jws.Payload, &req); err != nil {
+		return err
+	}
+	eab := req.ExternalAccountBinding
+	if eab == nil {
+		return fmt.Errorf("no external account binding")
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(eab.Protected)
+	var header struct{ Alg, KID, URL string }
+	json.Unmarshal(protected, &header)
+	if header.Alg != "HS256" || header.KID != ca.eabKID || header.URL != ca.url("/account") {
+		return fmt.Errorf("bad external account binding header: %s", protected)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(eab.Payload)
+	bound, err := jwkThumbprint(payload)
+	if err != nil {
+		return err
+	}
+	if key, _ := jwkThumbprint(jws.JWK); bound != key {
+		return fmt.Errorf("external account binding of another key")
+	}
+	mac := hmac.New(sha256.New, ca.eabKey)
+	mac.Write([]byte(eab.Protected + "." + eab.Payload))
+	if sig, _ := base64.RawURLEncoding.DecodeString(eab.Signature); !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("bad external account binding signature")
+	}
+	return nil
+}
+
+func (ca *testCA) orderJSON(id int) map[string]any {
+	o := ca.orders[id]
+	status := "ready"
+	var authzURLs []string
+	for _, i := range o.authzs {
+		authzURLs = append(authzURLs, ca.url("/authz/%d", i))
+		switch ca.authzs[i].status {
+		case "invalid":
+			status = "invalid"
+		case "pending":
+			if status != "invalid" {
+				status = "pending"
+			}
+		}
+	}
+	var identifiers []map[string]string
+	for _, ident := range o.identifiers {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": ident})
+	}
+	order := map[string]any{
+		"identifiers":    identifiers,
+		"authorizations": authzURLs,
+		"finalize":       ca.url("/finalize/%d", id),
+	}
+	if o.cert != nil {
+		status = "valid"
+		order["certificate"] = ca.url("/cert/%d", id)
+	}
+	order["status"] = status
+	return order
+}
+
+func (ca *testCA) authzJSON(id int) map[string]any {
+	a := ca.authzs[id]
+	var challenges []map[string]any
+	for _, typ := range ca.challengeTypes {
+		if a.wildcard && typ != "dns-01" {
+			continue
+		}
+		status := "pending"
+		if a.status != "pending" && a.validated == typ {
+			status = a.status
+		}
+		challenges = append(challenges, map[string]any{"type": typ, "url": ca.url("/challenge/%d/%s", id, typ),
+			"token": a.token, "status": status})
+	}
+	return map[string]any{
+		"identifier": map[string]string{"type": "dns", "value": a.domain},
+		"status":     a.status,
+		"wildcard":   a.wildcard,
+		"challenges": challenges,
+	}
+}
+
+// validate checks the response of a challenge
+func (ca *testCA) validate(a *testAuthz, typ string) error {
+	keyAuth := a.token + "." + a.thumbprint
+	switch typ {
+	case "http-01":
+		if ca.httpHandler == nil {
+			return fmt.Errorf("no HTTP handler")
+		}
+		rec := httptest.NewRecorder()
+		ca.httpHandler.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+a.domain+"/.well-known/acme-challenge/"+a.token, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != keyAuth {
+			return fmt.Errorf("bad response: %d %q", rec.Code, rec.Body.String())
+		}
+	case "tls-alpn-01":
+		if ca.getCertificate == nil {
+			return fmt.Errorf("no TLS handler")
+		}
+		cert, err := testHandshake(ca.getCertificate, a.domain, "acme-tls/1")
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte(keyAuth))
+		want, _ := asn1.Marshal(sum[:])
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) && ext.Critical && string(ext.Value) == string(want) &&
+				cert.VerifyHostname(a.domain) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("bad challenge certificate")
+	case "dns-01":
+		if ca.lookupTXT == nil {
+			return fmt.Errorf("no DNS")
+		}
+		sum := sha256.Sum256([]byte(keyAuth))
+		if !slices.Contains(ca.lookupTXT("_acme-challenge."+a.domain), base64.RawURLEncoding.EncodeToString(sum[:])) {
+			return fmt.Errorf("TXT record not found")
+		}
+	default:
+		return fmt.Errorf("unknown challenge type")
+	}
+	return nil
+}
+
+// issue signs the certificate request of a ready order
+func (ca *testCA) issue(o *testOrder, der []byte) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	names, identifiers := slices.Clone(csr.DNSNames), slices.Clone(o.identifiers)
+	slices.Sort(names)
+	slices.Sort(identifiers)
+	if !slices.Equal(names, identifiers) {
+		return nil, fmt.Errorf("CSR names %v don't match the order %v", csr.DNSNames, o.identifiers)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(ca.issued) + 2)),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if der, err = x509.CreateCertificate(rand.Reader, template, ca.root, csr.PublicKey, ca.key); err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca.issued = append(ca.issued, cert)
+	return der, nil
+}
+
+// testJWS is the decoded body of an ACME request
+type testJWS struct {
+	JWK     json.RawMessage
+	KID     string
+	Payload []byte
+}
+
+func readTestJWS(r *http.Request) (*testJWS, error) {
+	var body struct{ Protected, Payload string }
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, err
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(body.Protected)
+	if err != nil {
+		return nil, err
+	}
+	jws := &testJWS{}
+	if err := json.Unmarshal(protected, jws); err != nil {
+		return nil, err
+	}
+	jws.Payload, err = base64.RawURLEncoding.DecodeString(body.Payload)
+	return jws, err
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of an EC or RSA public key in JWK format
+func jwkThumbprint(jwk json.RawMessage) (string, error) {
+	var key struct{ Kty, Crv, X, Y, E, N string }
+	if err := json.Unmarshal(jwk, &key); err != nil {
+		return "", err
+	}
+	var canonical string
+	switch key.Kty {
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, key.Crv, key.X, key.Y)
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, key.E, key.N)
+	default:
+		return "", fmt.Errorf("unknown key type: %q", key.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func writeACMEError(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+// testHandshake returns the certificate served by getCertificate for a TLS client connecting to name
+func testHandshake(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), name string, protos ...string) (*x509.Certificate, error) {
+	return testHandshakeConfig(getCertificate, &tls.Config{ServerName: name, NextProtos: protos, InsecureSkipVerify: true})
+}
+
+// testHandshakeConfig returns the certificate served by getCertificate for a TLS client with the config
+func testHandshakeConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), config *tls.Config) (*x509.Certificate, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn := tls.Server(server, &tls.Config{GetCertificate: getCertificate, NextProtos: config.NextProtos})
+		conn.Handshake()
+		conn.Close()
+	}()
+	conn := tls.Client(client, config)
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	if err := conn.HandshakeContext(context.Background()); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+// newTestACMEServer returns a server issuing certificates from the CA for the routes
+func newTestACMEServer(t *testing.T, ca *testCA, acme ACMEConfig, routes ...string) *Server {
+	s := &Server{
+		config:   ServerConfig{CertsDir: t.TempDir(), ACME: acme},
+		certRate: newCertRateLimiter(0),
+	}
+	s.baseCtx, s.cancelBaseCtx = context.WithCancel(context.Background())
+	t.Cleanup(s.cancelBaseCtx)
+	setTestRoutes(s, routes...)
+	s.initCertManagers()
+	ca.serve(s)
+	return s
+}
+
+func setTestRoutes(s *Server, routes ...string) {
+	table := newRoutingTable()
+	for _, route := range routes {
+		table.mux.Add(route, http.NotFoundHandler(), route)
+	}
+	s.routes.Store(table)
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/razzie/razvhost/pkg/dns01"
+	"github.com/razzie/razvhost/pkg/mux"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	wildcardRenewBefore   = 30 * 24 * time.Hour
+	wildcardRetryInterval = 10 * time.Minute
+	wildcardIssueTimeout  = 10 * time.Minute
+	acmeAccountKeyName    = "acme_account+key" // shared with autocert
+)
+
+// wildcardIssuer requests *.domain certificates with DNS-01 challenges,
+// so every subdomain of a wildcard route is served by a single certificate
+type wildcardIssuer struct {
+	config  ACMEConfig
+	cache   autocert.Cache
+	account *acmeAccount
+	mtx     sync.Mutex
+	certs   map[string]*wildcardCert
+}
+
+// wildcardCert is the state of a wildcard certificate. Its fields are guarded by wildcardIssuer.mtx.
+type wildcardCert struct {
+	ready    chan struct{} // closed when the first load or issuance attempt is done
+	cert     *tls.Certificate
+	err      error
+	retry    time.Time // no new attempt is made before this after a failure
+	renewing bool
+}
+
+func newWildcardIssuer(config ACMEConfig, cache autocert.Cache, account *acmeAccount) *wildcardIssuer {
+	return &wildcardIssuer{
+		config:  config,
+		cache:   cache,
+		account: account,
+		certs:   make(map[string]*wildcardCert),
+	}
+}
+
+// wildcardCertificate returns the certificate of the *.domain route serving the hostname, if the hostname
+// is a direct subdomain of it and DNS-01 challenges are enabled. Otherwise ok is false.
+func (s *Server) wildcardCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, ok bool, err error) {
+	issuer := s.wildcardCerts
+	if issuer == nil {
+		return nil, false, nil
+	}
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return nil, false, nil
+		}
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	pattern, found := s.routes.Load().mux.HostPattern(name)
+	if !found || !strings.HasPrefix(pattern, "*.") || mux.IsPattern(pattern[2:]) || strings.Contains(pattern, ":") {
+		return nil, false, nil
+	}
+	if strings.Contains(strings.TrimSuffix(name, pattern[1:]), ".") {
+		return nil, false, nil // a wildcard certificate only covers one label
+	}
+	cert, err = issuer.get(hello.Context(), pattern)
+	return cert, true, err
+}
+
+// get returns the certificate of a *.domain wildcard, loading it from the cache or requesting it if needed
+func (w *wildcardIssuer) get(ctx context.Context, domain string) (*tls.Certificate, error) {
+	w.mtx.Lock()
+	state := w.certs[domain]
+	if state == nil || (state.cert == nil && state.err != nil && time.Now().After(state.retry)) {
+		state = &wildcardCert{ready: make(chan struct{})}
+		w.certs[domain] = state
+		go w.load(domain, state)
+	}
+	w.mtx.Unlock()
+
+	select {
+	case <-state.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if state.cert == nil {
+		return nil, state.err
+	}
+	if time.Until(state.cert.Leaf.NotAfter) < wildcardRenewBefore && !state.renewing && time.Now().After(state.retry) {
+		state.renewing = true
+		go w.renew(domain, state)
+	}
+	return state.cert, nil
+}
+
+func (w *wildcardIssuer) load(domain string, state *wildcardCert) {
+	defer close(state.ready)
+	ctx, cancel := context.WithTimeout(context.Background(), wildcardIssueTimeout)
+	defer cancel()
+
+	cert, err := w.cacheGet(ctx, domain)
+	if err != nil {
+		if !errors.Is(err, autocert.ErrCacheMiss) {
+			log.Printf("Wildcard certificate for %s: %v", domain, err)
+		}
+		cert, err = w.issue(ctx, domain)
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	state.cert, state.err = cert, err
+	if err != nil {
+		state.retry = time.Now().Add(wildcardRetryInterval)
+		log.Printf("Wildcard certificate for %s: %v", domain, err)
+	}
+}
+
+func (w *wildcardIssuer) renew(domain string, state *wildcardCert) {
+	ctx, cancel := context.WithTimeout(context.Background(), wildcardIssueTimeout)
+	defer cancel()
+	cert, err := w.issue(ctx, domain)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	state.renewing = false
+	if err != nil {
+		state.retry = time.Now().Add(wildcardRetryInterval)
+		log.Printf("Wildcard certificate for %s: renewal failed: %v", domain, err)
+		return
+	}
+	state.cert = cert
+}
+
+// reload drops the certificates that are not being requested, so they are read from the cache again on next use
+func (w *wildcardIssuer) reload() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for domain, state := range w.certs {
+		select {
+		case <-state.ready:
+			if !state.renewing {
+				delete(w.certs, domain)
+			}
+		default:
+		}
+	}
+}
+
+// forget drops the certificate of a *.domain wildcard, so it is loaded from the cache or requested again on next use
+func (w *wildcardIssuer) forget(domain string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	delete(w.certs, domain)
+}
+
+// renewNow requests a new certificate for a *.domain wildcard regardless of the expiry of the current one
+func (w *wildcardIssuer) renewNow(ctx context.Context, domain string) (*tls.Certificate, error) {
+	cert, err := w.issue(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if state := w.certs[domain]; state != nil && state.cert != nil {
+		state.cert = cert
+	}
+	return cert, nil
+}
+
+// issue requests a certificate for a *.domain wildcard and stores it in the cache
+func (w *wildcardIssuer) issue(ctx context.Context, domain string) (*tls.Certificate, error) {
+	log.Println("Requesting wildcard certificate for", domain)
+	client, err := w.account.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := orderCertificate(ctx, client, domain, w.config.KeyType == "rsa", func(ctx context.Context, authzURL string) error {
+		return w.authorize(ctx, client, authzURL, domain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Wildcard certificate for %s issued (expires %s)", domain, cert.Leaf.NotAfter.Format("2006-01-02"))
+
+	data, err := encodeCertificate(cert)
+	if err == nil {
+		err = w.cache.Put(ctx, wildcardCacheKey(domain), data)
+	}
+	if err != nil {
+		log.Printf("Wildcard certificate for %s: cannot store in cache: %v", domain, err)
+	}
+	return cert, nil
+}
+
+// authorize publishes the DNS-01 challenge record of the authorization of a domain and waits until the CA validates it
+func (w *wildcardIssuer) authorize(ctx context.Context, client *acme.Client, authzURL, domain string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil || authz.Status == acme.StatusValid {
+		return err
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("%s: the CA offered no dns-01 challenge", domain)
+	}
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := dns01.ChallengeName(domain)
+	if err := w.config.DNSProvider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("cannot create %s record: %v", fqdn, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := w.config.DNSProvider.CleanUp(ctx, fqdn, value); err != nil {
+			log.Printf("Cannot remove %s record: %v", fqdn, err)
+		}
+	}()
+
+	select {
+	case <-time.After(w.config.DNSDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// cacheGet returns the cached certificate of a wildcard, or autocert.ErrCacheMiss if there is none or it has expired
+func (w *wildcardIssuer) cacheGet(ctx context.Context, domain string) (*tls.Certificate, error) {
+	data, err := w.cache.Get(ctx, wildcardCacheKey(domain))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCachedCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return cert, nil
+}
+
+// wildcardCacheKey returns the cache key of a *.domain certificate. '*' is not allowed in file names on every OS,
+// and the '_' label cannot collide with autocert's hostname keys.
+func wildcardCacheKey(domain string) string {
+	return "_" + strings.TrimPrefix(domain, "*")
+}
+
+// parseCachedCertificate parses a certificate stored by autocert or encodeCertificate
+func parseCachedCertificate(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// encodeCertificate encodes a certificate in the PEM format of autocert: the private key followed by the chain
+func encodeCertificate(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	switch key := cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	case *rsa.PrivateKey:
+		pem.Encode(&buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	default:
+		return nil, fmt.Errorf("unknown private key type")
+	}
+	for _, der := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return buf.Bytes(), nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unknown private key type: %s", block.Type)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// testDNSProvider keeps the DNS-01 challenge records in memory
+type testDNSProvider struct {
+	mtx     sync.Mutex
+	records map[string][]string
+}
+
+func (p *testDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.records[fqdn] = append(p.records[fqdn], value)
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.records[fqdn] = slices.DeleteFunc(p.records[fqdn], func(v string) bool { return v == value })
+	return nil
+}
+
+func (p *testDNSProvider) lookupTXT(name string) []string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return slices.Clone(p.records[name+"."])
+}
+
+func TestWildcardIssuance(t *testing.T) {
+	for _, tt := range []struct {
+		keyType string
+		want    x509.PublicKeyAlgorithm
+	}{
+		{"auto", x509.ECDSA},
+		{"ecdsa", x509.ECDSA},
+		{"rsa", x509.RSA},
+	} {
+		t.Run(tt.keyType, func(t *testing.T) {
+			dns := &testDNSProvider{records: make(map[string][]string)}
+			ca := newTestCA(t, "dns-01")
+			ca.eabKID, ca.eabKey = "kid-1", []byte("0123456789abcdef0123456789abcdef")
+			ca.lookupTXT = dns.lookupTXT
+			acme := ca.acmeConfig(t, tt.keyType)
+			acme.DNSProvider = dns
+			s := newTestACMEServer(t, ca, acme, "*.example.com")
+
+			first, err := testHandshake(s.getCertificate, "a.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.PublicKeyAlgorithm != tt.want || !slices.Equal(first.DNSNames, []string{"*.example.com"}) {
+				t.Errorf("%s certificate for %v issued, want %s for *.example.com", first.PublicKeyAlgorithm, first.DNSNames, tt.want)
+			}
+			second, err := testHandshake(s.getCertificate, "b.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !second.Equal(first) || ca.issuedCount() != 1 {
+				t.Error("subdomains are not served by the same certificate")
+			}
+			if records := dns.lookupTXT("_acme-challenge.example.com"); len(records) > 0 {
+				t.Errorf("challenge records left: %v", records)
+			}
+
+			// deeper subdomains are not covered by the wildcard certificate
+			if _, err := testHandshake(s.getCertificate, "x.a.example.com"); err == nil {
+				t.Error("certificate served for a deeper subdomain")
+			}
+		})
+	}
+}
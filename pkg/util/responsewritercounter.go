@@ -53,6 +53,11 @@ func (counter *ResponseWriterCounter) Flush() {
 	}
 }
 
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController
+func (counter *ResponseWriterCounter) Unwrap() http.ResponseWriter {
+	return counter.ResponseWriter
+}
+
 func (counter *ResponseWriterCounter) Count() int64 {
 	return atomic.LoadInt64(&counter.count)
 }